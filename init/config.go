@@ -0,0 +1,317 @@
+package init
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"fornaxian.tech/config"
+	"fornaxian.tech/pixeldrain_web/webcontroller"
+	"github.com/BurntSushi/toml"
+)
+
+// DefaultConfigFile is the config file which is loaded when no other file is
+// specified
+const DefaultConfigFile = "pdwebconf.toml"
+
+// EnvPrefix is the prefix of the environment variables which override config
+// values. The rest of the variable name is the TOML key in upper case, for
+// example PDWEB_API_URL_INTERNAL
+const EnvPrefix = "PDWEB_"
+
+// ConfigOptions controls where the configuration is loaded from
+type ConfigOptions struct {
+	// Path of the config file. DefaultConfigFile is used if empty
+	File string
+
+	// Command line overrides, created with RegisterConfigFlags. Optional
+	Flags *ConfigFlags
+}
+
+// ConfigFlags holds the command line flags which override config values. Every
+// field of the config has a flag with the TOML key as name, with underscores
+// replaced by dashes
+type ConfigFlags struct {
+	fs     *flag.FlagSet
+	values map[string]*string             // Flag name -> value
+	fields map[string]reflect.StructField // Flag name -> config field
+}
+
+// RegisterConfigFlags registers a flag for every config field in the flag set.
+// The flags only take effect if they are set on the command line
+func RegisterConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+	var cf = &ConfigFlags{
+		fs:     fs,
+		values: make(map[string]*string),
+		fields: make(map[string]reflect.StructField),
+	}
+	forEachConfigField(func(key string, field reflect.StructField) {
+		var name = strings.ReplaceAll(key, "_", "-")
+		cf.fields[name] = field
+		cf.values[name] = fs.String(name, "", "Override config value "+key)
+	})
+	return cf
+}
+
+// forEachConfigField calls the function for every field in the config which
+// has a TOML key
+func forEachConfigField(fn func(key string, field reflect.StructField)) {
+	var t = reflect.TypeOf(webcontroller.Config{})
+	for i := 0; i < t.NumField(); i++ {
+		var key, _, _ = strings.Cut(t.Field(i).Tag.Get("toml"), ",")
+		if key != "" && key != "-" {
+			fn(key, t.Field(i))
+		}
+	}
+}
+
+// LoadConfig loads the config file and applies the overrides from the
+// environment and the command line flags, in that order
+func LoadConfig(opts ConfigOptions) (conf webcontroller.Config, err error) {
+	if opts.File == "" {
+		opts.File = DefaultConfigFile
+	}
+
+	if _, err = config.New(
+		DefaultConfig,
+		filepath.Dir(opts.File),
+		filepath.Base(opts.File),
+		&conf,
+		true,
+	); err != nil {
+		return conf, fmt.Errorf("failed to load config file '%s': %w", opts.File, err)
+	}
+
+	var errs []error
+	forEachConfigField(func(key string, field reflect.StructField) {
+		if val, ok := os.LookupEnv(EnvPrefix + strings.ToUpper(key)); ok {
+			if err := setConfigField(&conf, field, val); err != nil {
+				errs = append(errs, fmt.Errorf("environment variable %s%s: %w", EnvPrefix, strings.ToUpper(key), err))
+			}
+		}
+	})
+
+	if opts.Flags != nil {
+		opts.Flags.fs.Visit(func(f *flag.Flag) {
+			var field, ok = opts.Flags.fields[f.Name]
+			if !ok {
+				return // Not a config flag
+			}
+			if err := setConfigField(&conf, field, *opts.Flags.values[f.Name]); err != nil {
+				errs = append(errs, fmt.Errorf("flag -%s: %w", f.Name, err))
+			}
+		})
+	}
+
+	return conf, errors.Join(errs...)
+}
+
+// setConfigField parses an override value and stores it in the config. Strings,
+// booleans and numbers are parsed as-is, all other types are parsed as TOML
+// values. Lists of strings can also be passed as a comma separated list
+func setConfigField(conf *webcontroller.Config, field reflect.StructField, val string) error {
+	var v = reflect.ValueOf(conf).Elem().FieldByIndex(field.Index)
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String &&
+			!strings.HasPrefix(strings.TrimSpace(val), "[") {
+			var list = reflect.MakeSlice(v.Type(), 0, 0)
+			for _, s := range strings.Split(val, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					list = reflect.Append(list, reflect.ValueOf(s).Convert(v.Type().Elem()))
+				}
+			}
+			v.Set(list)
+			return nil
+		}
+
+		// Decode the value as a TOML document with a single key
+		var target = reflect.New(reflect.StructOf([]reflect.StructField{{
+			Name: "V",
+			Type: v.Type(),
+			Tag:  `toml:"v"`,
+		}}))
+		if _, err := toml.Decode("v = "+val, target.Interface()); err != nil {
+			return err
+		}
+		v.Set(target.Elem().Field(0))
+	}
+	return nil
+}
+
+// ValidateConfig checks if the configuration can be used to run the web server
+func ValidateConfig(conf webcontroller.Config) error {
+	var errs []error
+
+	if u, err := url.Parse(conf.APIURLInternal); err != nil {
+		errs = append(errs, fmt.Errorf("api_url_internal is not a valid URL: %w", err))
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		errs = append(errs, fmt.Errorf("api_url_internal must be an absolute http(s) URL, got '%s'", conf.APIURLInternal))
+	}
+	if _, err := url.Parse(conf.APIURLExternal); err != nil {
+		errs = append(errs, fmt.Errorf("api_url_external is not a valid URL: %w", err))
+	}
+
+	if conf.APISocketPath != "" {
+		if stat, err := os.Stat(conf.APISocketPath); err != nil {
+			errs = append(errs, fmt.Errorf("api_socket_path: %w", err))
+		} else if stat.Mode()&os.ModeSocket == 0 {
+			errs = append(errs, fmt.Errorf("api_socket_path '%s' is not a socket", conf.APISocketPath))
+		}
+	}
+
+	if conf.DocsPrefix != "" && (!strings.HasPrefix(conf.DocsPrefix, "/") || strings.HasSuffix(conf.DocsPrefix, "/")) {
+		errs = append(errs, fmt.Errorf("docs_prefix must start with a slash and not end with one, got '%s'", conf.DocsPrefix))
+	}
+	if conf.DocsIndex != "" && !strings.HasPrefix(conf.DocsIndex, "/") {
+		errs = append(errs, fmt.Errorf("docs_index must start with a slash, got '%s'", conf.DocsIndex))
+	}
+
+	for _, p := range conf.RobotsDisallow {
+		if !strings.HasPrefix(p, "/") {
+			errs = append(errs, fmt.Errorf("robots_disallow paths must start with a slash, got '%s'", p))
+		}
+	}
+	for _, c := range conf.SecurityContact {
+		if !strings.HasPrefix(c, "mailto:") && !strings.HasPrefix(c, "tel:") && !strings.HasPrefix(c, "https://") {
+			errs = append(errs, fmt.Errorf("security_contact must be a mailto:, tel: or https:// URI, got '%s'", c))
+		}
+	}
+	if conf.SecurityPolicy != "" && !strings.HasPrefix(conf.SecurityPolicy, "https://") {
+		errs = append(errs, fmt.Errorf("security_policy must be an https:// URL, got '%s'", conf.SecurityPolicy))
+	}
+	if conf.SecurityAcknowledgments != "" && !strings.HasPrefix(conf.SecurityAcknowledgments, "https://") {
+		errs = append(errs, fmt.Errorf("security_acknowledgments must be an https:// URL, got '%s'", conf.SecurityAcknowledgments))
+	}
+	if !conf.SecurityExpires.IsZero() && conf.SecurityExpires.Before(time.Now()) {
+		errs = append(errs, fmt.Errorf("security_expires is in the past: %s", conf.SecurityExpires))
+	}
+	if conf.ChangePasswordURL != "" {
+		if _, err := url.Parse(conf.ChangePasswordURL); err != nil {
+			errs = append(errs, fmt.Errorf("change_password_url is not a valid URL: %w", err))
+		}
+	}
+
+	if templates, err := filepath.Glob(filepath.Join(conf.ResourceDir, "template", "*.html")); err != nil {
+		errs = append(errs, fmt.Errorf("resource_dir: %w", err))
+	} else if len(templates) == 0 {
+		errs = append(errs, fmt.Errorf("resource_dir '%s' does not contain any templates", conf.ResourceDir))
+	}
+
+	return errors.Join(errs...)
+}
+
+// CheckConfig loads and validates the configuration and writes the effective
+// values to w as TOML. Secret values are redacted
+func CheckConfig(w io.Writer, opts ConfigOptions) error {
+	conf, err := LoadConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	var redacted = conf
+	forEachConfigField(func(key string, field reflect.StructField) {
+		var v = reflect.ValueOf(&redacted).Elem().FieldByIndex(field.Index)
+		if isSecretField(key, field) && v.Kind() == reflect.String && v.String() != "" {
+			v.SetString("REDACTED")
+		}
+	})
+	if err = toml.NewEncoder(w).Encode(redacted); err != nil {
+		return err
+	}
+
+	return ValidateConfig(conf)
+}
+
+// CompressAssets loads the configuration and writes precompressed copies of
+// the static files in the resource directory
+func CompressAssets(opts ConfigOptions) error {
+	conf, err := LoadConfig(opts)
+	if err != nil {
+		return err
+	}
+	return webcontroller.CompressAssets(conf.ResourceDir)
+}
+
+// LintThemes loads the configuration and checks the contrast of the themes,
+// the report is written to w
+func LintThemes(w io.Writer, opts ConfigOptions) error {
+	conf, err := LoadConfig(opts)
+	if err != nil {
+		return err
+	}
+	return webcontroller.LintThemes(w, conf.ResourceDir)
+}
+
+// ExportTheme loads the configuration and writes a theme in an export format
+// to w
+func ExportTheme(w io.Writer, opts ConfigOptions, name, format string) error {
+	conf, err := LoadConfig(opts)
+	if err != nil {
+		return err
+	}
+	return webcontroller.ExportTheme(w, conf.ResourceDir, name, format)
+}
+
+// configDiff returns a description of every config value which is different
+// between the two configs. Secret values are not included in the description
+func configDiff(old, conf webcontroller.Config) (diff []string) {
+	forEachConfigField(func(key string, field reflect.StructField) {
+		var a = reflect.ValueOf(old).FieldByIndex(field.Index).Interface()
+		var b = reflect.ValueOf(conf).FieldByIndex(field.Index).Interface()
+		if reflect.DeepEqual(a, b) {
+			return
+		}
+
+		if isSecretField(key, field) {
+			diff = append(diff, key+" (value redacted)")
+		} else {
+			diff = append(diff, fmt.Sprintf("%s: %v -> %v", key, a, b))
+		}
+	})
+	return diff
+}
+
+// isSecretField returns true if the value of the field should not be printed.
+// Fields can be marked as secret with the `secret:"true"` struct tag, fields
+// with a name that looks like a credential are also considered secret
+func isSecretField(key string, field reflect.StructField) bool {
+	if field.Tag.Get("secret") == "true" {
+		return true
+	}
+	for _, s := range []string{"secret", "password", "token", "_key"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,8 +2,10 @@ package init
 
 import (
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"fornaxian.tech/config"
 	"fornaxian.tech/log"
 	"fornaxian.tech/pixeldrain_web/webcontroller"
 	"github.com/julienschmidt/httprouter"
@@ -11,6 +13,8 @@ import (
 
 // DefaultConfig is the default configuration for Pixeldrain Web
 const DefaultConfig = `## Pixeldrain Web UI server configuration
+##
+## Send SIGHUP to the server to reload this file without restarting
 
 # Address used in the browser for making requests directly to the API. Can be
 # relative to the current domain name
@@ -34,25 +38,90 @@ debug_mode            = true
 # api_url_internal
 proxy_api_requests    = true
 
-# When this is true every request will return a maintainance HTML page
+# Content security policy mode. Can be "off", "report_only" or "enforce".
+# Violations are logged by the /csp-report endpoint
+csp_mode              = "report_only"
+
+# Extra sources to allow in the content security policy, per directive
+csp_sources           = { "script-src" = ["https://www.google.com/recaptcha/", "https://www.gstatic.com/recaptcha/", "https://cdn.jsdelivr.net"], "frame-src" = ["https://www.google.com/recaptcha/"], "connect-src" = ["https://api.mollie.com"] }
+
+referrer_policy            = "strict-origin-when-cross-origin"
+permissions_policy         = "camera=(), microphone=(), geolocation=(), interest-cohort=()"
+cross_origin_opener_policy = "same-origin-allow-popups"
+
+# When this is true every request will return a maintainance HTML page. The
+# maintenance mode can also be changed at runtime in the admin panel, or by
+# sending SIGUSR1 (toggle maintenance) or SIGUSR2 (toggle read-only mode)
 maintenance_mode      = false
+
+# In read-only mode pages can be viewed, but uploads and forms are disabled
+maintenance_read_only = false
+
+# IP addresses and CIDR ranges which can use the website during maintenance.
+# Admins can always use the website
+maintenance_bypass_ips = []
+
+# Default value for the Retry-After header during maintenance, in seconds
+maintenance_retry_after = 3600
+
+# Banners shown on every page ahead of planned downtime. Example:
+# announcements = [{message = "Database upgrade", start = 2024-07-01T20:00:00Z, end = 2024-07-01T22:00:00Z}]
+announcements         = []
+
+# Granular permissions for the admin panel. Maps usernames to a list of roles.
+# Available roles are abuse_moderator, billing, support and superadmin. Roles
+# only apply to users with the admin flag, admins who are not listed here are
+# superadmins. Example:
+# admin_roles = { "alice" = ["abuse_moderator", "support"], "bob" = ["billing"] }
+admin_roles           = {}
+
+# The markdown documents in res/include/md are served as documentation pages.
+# The URL of a document is its path in the directory without extension, after
+# the docs_prefix. An index of all documents is served on docs_index. Without a
+# prefix the API documentation is on the same paths as the API proxy
+docs_prefix           = "/docs"
+docs_index            = "/docs"
+
+# Paths which crawlers are asked not to visit in robots.txt. The public pages
+# and documents are listed in /sitemap.xml
+robots_disallow       = ["/u/", "/l/", "/d/"]
+
+# Contents of /.well-known/security.txt, see RFC 9116. The file is only served
+# when there is at least one contact (a mailto: or https:// URL). When
+# security_expires is not set the file expires six months after it is served.
+# Example:
+# security_contact = ["mailto:security@example.com"]
+# security_expires = 2025-12-31T00:00:00Z
+security_contact             = []
+security_encryption          = ""
+security_policy              = ""
+security_acknowledgments     = ""
+security_preferred_languages = "en"
+
+# Where password managers are sent to change the user's password
+change_password_url   = "/user/settings"
+
+# Key for signing the logo paths in the theme URLs of branded directories, so
+# theme.css only downloads logos which are used in a branding. When empty a
+# random key is generated at startup. Set it when running multiple servers
+brand_image_key       = ""
 `
 
-// Init initializes the Pixeldrain Web UI controllers
+// Init initializes the Pixeldrain Web UI controllers. The config is loaded
+// from the default config file and the environment
 func Init(r *httprouter.Router, prefix string, setLogLevel bool) {
+	InitWithOptions(r, prefix, setLogLevel, ConfigOptions{})
+}
+
+// InitWithOptions initializes the Pixeldrain Web UI controllers with a custom
+// config file and command line overrides
+func InitWithOptions(r *httprouter.Router, prefix string, setLogLevel bool, opts ConfigOptions) {
 	log.Colours = true
 	log.Info("Starting web UI server (PID %v)", os.Getpid())
 
-	var conf webcontroller.Config
-	var _, err = config.New(
-		DefaultConfig,
-		"",
-		"pdwebconf.toml",
-		&conf,
-		true,
-	)
+	conf, err := LoadConfig(opts)
 	if err != nil {
-		log.Error("Failed to load config file: %s", err)
+		log.Error("Failed to load config: %s", err)
 		os.Exit(1)
 	}
 
@@ -60,5 +129,64 @@ func Init(r *httprouter.Router, prefix string, setLogLevel bool) {
 		log.SetLogLevel(log.LevelInfo)
 	}
 
-	webcontroller.New(r, prefix, conf)
+	var wc = webcontroller.New(r, prefix, conf)
+
+	// Maintenance mode can be toggled with signals. SIGHUP reloads the config
+	var sig = make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	go func() {
+		for s := range sig {
+			if s == syscall.SIGHUP {
+				conf = reloadConfig(wc, conf, opts, setLogLevel)
+				continue
+			}
+
+			var target = webcontroller.MaintenanceFull
+			if s == syscall.SIGUSR2 {
+				target = webcontroller.MaintenanceReadOnly
+			}
+
+			if wc.MaintenanceMode() == target {
+				wc.SetMaintenanceMode(webcontroller.MaintenanceOff, "", time.Time{})
+			} else {
+				wc.SetMaintenanceMode(target, "", time.Time{})
+			}
+		}
+	}()
+}
+
+// reloadConfig loads the config file again and applies it to the web
+// controller. If the new config is invalid it is refused and the old config is
+// returned
+func reloadConfig(wc *webcontroller.WebController, old webcontroller.Config, opts ConfigOptions, setLogLevel bool) webcontroller.Config {
+	log.Info("Reloading configuration")
+
+	conf, err := LoadConfig(opts)
+	if err == nil {
+		err = ValidateConfig(conf)
+	}
+	if err == nil {
+		err = wc.Reload(conf)
+	}
+	if err != nil {
+		log.Error("Refusing new configuration: %s", err)
+		return old
+	}
+
+	var changed = configDiff(old, conf)
+	for _, line := range changed {
+		log.Info("Config changed: %s", line)
+	}
+	if len(changed) == 0 {
+		log.Info("Configuration reloaded, nothing changed")
+	}
+
+	if setLogLevel {
+		if conf.DebugMode {
+			log.SetLogLevel(log.LevelDebug)
+		} else {
+			log.SetLogLevel(log.LevelInfo)
+		}
+	}
+	return conf
 }
@@ -2,8 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"strings"
 
 	"fornaxian.tech/log"
 	web "fornaxian.tech/pixeldrain_web/init"
@@ -19,7 +22,45 @@ func main() {
 	var sock = flag.Bool("systemd-socket", false, "Enable/disable systemd socket activation")
 	var listen = flag.String("listen", ":8081", "The address which the API server will listen on")
 	var prefix = flag.String("prefix", "", "Prefix that comes before the API URL")
+	var configFile = flag.String("config", web.DefaultConfigFile, "Path of the configuration file")
+	var configOpts = web.ConfigOptions{Flags: web.RegisterConfigFlags(flag.CommandLine)}
 	flag.Parse()
+	configOpts.File = *configFile
+
+	// Subcommands
+	var args = flag.Args()
+	switch cmd := strings.Join(args, " "); {
+	case cmd == "":
+	case cmd == "config check":
+		if err = web.CheckConfig(os.Stdout, configOpts); err != nil {
+			fmt.Fprintf(os.Stderr, "Configuration is invalid:\n%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "Configuration is valid")
+		return
+	case cmd == "assets compress":
+		if err = web.CompressAssets(configOpts); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to compress assets: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	case cmd == "themes lint":
+		if err = web.LintThemes(os.Stdout, configOpts); err != nil {
+			fmt.Fprintf(os.Stderr, "Themes are not accessible:\n%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "All themes meet WCAG AA")
+		return
+	case len(args) == 4 && args[0] == "themes" && args[1] == "export":
+		if err = web.ExportTheme(os.Stdout, configOpts, args[2], args[3]); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to export theme: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'. Available commands: config check, assets compress, themes lint, themes export <theme> <format>\n", cmd)
+		os.Exit(2)
+	}
 
 	var listener net.Listener
 
@@ -38,7 +79,7 @@ func main() {
 	}
 
 	var router = httprouter.New()
-	web.Init(router, *prefix, true)
+	web.InitWithOptions(router, *prefix, true, configOpts)
 
 	if err = http.Serve(listener, router); err != nil {
 		log.Error("Can't listen and serve Pixeldrain Web: %v", err)
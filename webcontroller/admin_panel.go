@@ -1,23 +1,34 @@
 package webcontroller
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
+	"sort"
+	"strings"
 
 	"fornaxian.tech/log"
 	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+	"github.com/BurntSushi/toml"
+	"github.com/julienschmidt/httprouter"
 )
 
 func (wc *WebController) adminGlobalsForm(td *TemplateData, r *http.Request) (f Form) {
-	if !td.Authenticated || !td.User.IsAdmin {
+	if !td.AdminAllowed(adminSectionGlobals) {
 		return Form{Title: ";-)"}
 	}
 
 	f = Form{
-		Name:        "admin_globals",
-		Title:       "Pixeldrain global configuration",
-		PreFormHTML: template.HTML("<p>Careful! The slightest typing error could bring the whole website down</p>"),
+		Name:  "admin_globals",
+		Title: "Pixeldrain global configuration",
+		PreFormHTML: template.HTML(
+			"<p>Careful! The slightest typing error could bring the whole website down</p>" +
+				`<p>Export configuration as <a href="/admin/globals/export?format=toml">TOML</a> ` +
+				`or <a href="/admin/globals/export?format=json">JSON</a>, or ` +
+				`<a href="/admin/globals/import">import a configuration file</a></p>`,
+		),
 		SubmitLabel: "Submit",
 	}
 
@@ -56,36 +67,269 @@ func (wc *WebController) adminGlobalsForm(td *TemplateData, r *http.Request) (f
 	}
 
 	if f.ReadInput(r) {
-		var successfulUpdates = 0
-		for k, v := range f.Fields {
+		var changes = make(map[string]string)
+		for _, v := range f.Fields {
 			if v.EnteredValue == globalsMap[v.Name] {
 				continue // Change changes, no need to update
 			}
+			changes[v.Name] = v.EnteredValue
+		}
 
-			// Value changed, try to update global setting
-			if err = td.PixelAPI.AdminSetGlobals(v.Name, v.EnteredValue); err != nil {
-				if apiErr, ok := err.(pixelapi.Error); ok {
-					f.SubmitMessages = append(f.SubmitMessages, template.HTML(apiErr.Message))
-				} else {
-					log.Error("%s", err)
-					f.SubmitMessages = append(f.SubmitMessages, template.HTML(
-						fmt.Sprintf("Failed to set '%s': %s", v.Name, err),
-					))
-					return f
-				}
-			} else {
+		var updated = setGlobals(td, &f, changes)
+		for k, v := range f.Fields {
+			if updated[v.Name] {
 				f.Fields[k].DefaultValue = v.EnteredValue
-				successfulUpdates++
 			}
+		}
+	}
+	return f
+}
+
+// setGlobals applies the changed global settings through the API. Errors are
+// reported in the form's submit messages. The keys which were updated
+// successfully are returned
+func setGlobals(td *TemplateData, f *Form, changes map[string]string) (updated map[string]bool) {
+	updated = make(map[string]bool)
+
+	// Apply the changes in a predictable order
+	var keys = make([]string, 0, len(changes))
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		// Value changed, try to update global setting
+		if err := td.PixelAPI.AdminSetGlobals(key, changes[key]); err != nil {
+			if apiErr, ok := err.(pixelapi.Error); ok {
+				f.SubmitMessages = append(f.SubmitMessages, template.HTML(apiErr.Message))
+			} else {
+				log.Error("%s", err)
+				f.SubmitMessages = append(f.SubmitMessages, template.HTML(
+					fmt.Sprintf("Failed to set '%s': %s", key, err),
+				))
+				return updated
+			}
+		} else {
+			updated[key] = true
+		}
+	}
+
+	if len(f.SubmitMessages) == 0 {
+		// Request was a success
+		f.SubmitSuccess = true
+		f.SubmitMessages = []template.HTML{template.HTML(
+			fmt.Sprintf("Success! %d values updated", len(updated)),
+		)}
+	}
+	return updated
+}
+
+func (wc *WebController) serveAdminGlobalsExport(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newTemplateData(w, r)
+	if !wc.checkAccess(w, r, td, handlerOpts{Admin: adminSectionGlobals}) {
+		return
+	}
+
+	globals, err := td.PixelAPI.AdminGetGlobals()
+	if err != nil {
+		log.Error("Failed to get globals for export: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		wc.templates.Run(w, r, "500", td)
+		return
+	}
+
+	var globalsMap = make(map[string]string, len(globals))
+	for _, v := range globals {
+		globalsMap[v.Key] = v.Value
+	}
+
+	var buf bytes.Buffer
+	var format = r.URL.Query().Get("format")
+	switch format {
+	case "json":
+		var enc = json.NewEncoder(&buf)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(globalsMap)
+		w.Header().Set("Content-Type", "application/json")
+	case "toml", "":
+		err = toml.NewEncoder(&buf).Encode(globalsMap)
+		w.Header().Set("Content-Type", "application/toml")
+		format = "toml"
+	default:
+		http.Error(w, "unknown export format: "+format, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to encode globals: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		wc.templates.Run(w, r, "500", td)
+		return
+	}
 
+	w.Header().Set(
+		"Content-Disposition",
+		`attachment; filename=pixeldrain_globals.`+format,
+	)
+	w.Write(buf.Bytes())
+}
+
+// parseGlobalsFile decodes an exported globals file. JSON files are detected by
+// their opening brace, everything else is parsed as TOML
+func parseGlobalsFile(file string) (globals map[string]string, err error) {
+	globals = make(map[string]string)
+	if strings.HasPrefix(strings.TrimSpace(file), "{") {
+		if err = json.Unmarshal([]byte(file), &globals); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
 		}
-		if len(f.SubmitMessages) == 0 {
-			// Request was a success
+	} else if _, err = toml.Decode(file, &globals); err != nil {
+		return nil, fmt.Errorf("invalid TOML: %w", err)
+	}
+	return globals, nil
+}
+
+func (wc *WebController) adminGlobalsImportForm(td *TemplateData, r *http.Request) (f Form) {
+	if !td.AdminAllowed(adminSectionGlobals) {
+		return Form{Title: ";-)"}
+	}
+
+	globals, err := td.PixelAPI.AdminGetGlobals()
+	if err != nil {
+		f.SubmitMessages = []template.HTML{template.HTML(err.Error())}
+		return f
+	}
+	var globalsMap = make(map[string]string)
+	for _, v := range globals {
+		globalsMap[v.Key] = v.Value
+	}
+
+	// The second step of the import is a form with a checkbox for every changed
+	// value. The new values are passed along in hidden fields
+	if r.FormValue("form") == "admin_globals_apply" {
+		return adminGlobalsApplyForm(td, r, globalsMap)
+	}
+
+	f = Form{
+		Name:  "admin_globals_import",
+		Title: "Import global configuration",
+		PreFormHTML: template.HTML(
+			`<p>Upload a configuration file exported from ` +
+				`<a href="/admin/globals">the globals page</a>. You will be ` +
+				`able to review the changes before they are applied</p>`,
+		),
+		Fields: []Field{{
+			Name:        "globals_file",
+			Label:       "Configuration file",
+			Description: "TOML or JSON file with one value per key",
+			Type:        FieldTypeFile,
+		}},
+		SubmitLabel: "Compare",
+	}
+
+	if f.ReadInput(r) {
+		imported, err := parseGlobalsFile(f.FieldVal("globals_file"))
+		if err != nil {
+			f.SubmitMessages = []template.HTML{template.HTML(template.HTMLEscapeString(err.Error()))}
+			return f
+		} else if len(imported) == 0 {
+			f.SubmitMessages = []template.HTML{"The file does not contain any values"}
+			return f
+		}
+
+		var changes = make(map[string]string)
+		for k, v := range imported {
+			if cur, ok := globalsMap[k]; !ok || cur != v {
+				changes[k] = v
+			}
+		}
+		if len(changes) == 0 {
 			f.SubmitSuccess = true
-			f.SubmitMessages = []template.HTML{template.HTML(
-				fmt.Sprintf("Success! %d values updated", successfulUpdates),
-			)}
+			f.SubmitMessages = []template.HTML{template.HTML(fmt.Sprintf(
+				"All %d values in the file are equal to the live configuration", len(imported),
+			))}
+			return f
 		}
+
+		return globalsDiffForm(changes, globalsMap)
+	}
+	return f
+}
+
+// globalsDiffForm renders a form with a checkbox for every changed key. The
+// description of each field shows the difference between the live value and the
+// imported value
+func globalsDiffForm(changes, live map[string]string) (f Form) {
+	f = Form{
+		Name:  "admin_globals_apply",
+		Title: "Review imported configuration",
+		PreFormHTML: template.HTML(fmt.Sprintf(
+			"<p>%d values differ from the live configuration. Select the "+
+				"changes you want to apply</p>", len(changes),
+		)),
+		SubmitLabel: "Apply selected changes",
+		SubmitRed:   true,
+	}
+
+	var keys = make([]string, 0, len(changes))
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var diff string
+		if cur, ok := live[key]; ok {
+			diff = "<del>" + template.HTMLEscapeString(cur) + "</del><br/>" +
+				"<ins>" + template.HTMLEscapeString(changes[key]) + "</ins>"
+		} else {
+			diff = "new key: <ins>" + template.HTMLEscapeString(changes[key]) + "</ins>"
+		}
+
+		f.Fields = append(f.Fields, Field{
+			Name:         "apply_" + key,
+			DefaultValue: "on",
+			Label:        key,
+			Description:  template.HTML(diff),
+			Type:         FieldTypeCheckbox,
+		}, Field{
+			Name:         "value_" + key,
+			DefaultValue: changes[key],
+			Type:         FieldTypeHidden,
+		})
+	}
+	return f
+}
+
+func adminGlobalsApplyForm(td *TemplateData, r *http.Request, live map[string]string) (f Form) {
+	// Collect the submitted values so we can rebuild the diff form. The form
+	// was already parsed when the form name was read
+	var changes = make(map[string]string)
+	for k := range r.PostForm {
+		if key, ok := strings.CutPrefix(k, "value_"); ok {
+			changes[key] = r.PostForm.Get(k)
+		}
+	}
+
+	f = globalsDiffForm(changes, live)
+	if !f.ReadInput(r) {
+		return f
+	}
+
+	var selected = make(map[string]string)
+	for key, val := range changes {
+		if f.FieldVal("apply_"+key) == "on" {
+			selected[key] = val
+		}
+	}
+	if len(selected) == 0 {
+		f.SubmitMessages = []template.HTML{"No changes selected"}
+		return f
+	}
+
+	setGlobals(td, &f, selected)
+	if f.SubmitSuccess {
+		f.Fields = nil
+		f.PostFormHTML = `<p><a href="/admin/globals">Back to global configuration</a></p>`
 	}
 	return f
 }
@@ -0,0 +1,146 @@
+package webcontroller
+
+import (
+	"net/http"
+	"sort"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+)
+
+// adminRole is a set of permissions which can be granted to a user in the
+// admin_roles config table
+type adminRole string
+
+const (
+	adminRoleAbuseModerator adminRole = "abuse_moderator"
+	adminRoleBilling        adminRole = "billing"
+	adminRoleSupport        adminRole = "support"
+	adminRoleSuperadmin     adminRole = "superadmin"
+)
+
+// adminSection is a group of routes in the admin panel. The names are passed
+// to the admin panel so it can hide the sections the user can't access
+type adminSection string
+
+const (
+	// Special section which is allowed for every user with at least one role.
+	// This is used for the landing page of the admin panel
+	adminSectionPanel adminSection = "panel"
+
+	adminSectionStatus           adminSection = "status"
+	adminSectionBlockFiles       adminSection = "block_files"
+	adminSectionAbuseReports     adminSection = "abuse_reports"
+	adminSectionEmailReporters   adminSection = "email_reporters"
+	adminSectionIPBans           adminSection = "ip_bans"
+	adminSectionUserBans         adminSection = "user_bans"
+	adminSectionUserManagement   adminSection = "user_management"
+	adminSectionMollieSettlement adminSection = "mollie_settlements"
+	adminSectionPayPalTaxes      adminSection = "paypal_taxes"
+	adminSectionGlobals          adminSection = "globals"
+	adminSectionMaintenance      adminSection = "maintenance"
+)
+
+// adminRoleSections lists which sections of the admin panel every role can
+// access. The superadmin role can access everything
+var adminRoleSections = map[adminRole][]adminSection{
+	adminRoleAbuseModerator: {
+		adminSectionBlockFiles,
+		adminSectionAbuseReports,
+		adminSectionEmailReporters,
+		adminSectionIPBans,
+		adminSectionUserBans,
+	},
+	adminRoleBilling: {
+		adminSectionMollieSettlement,
+		adminSectionPayPalTaxes,
+	},
+	adminRoleSupport: {
+		adminSectionUserBans,
+		adminSectionUserManagement,
+	},
+	adminRoleSuperadmin: {
+		adminSectionStatus,
+		adminSectionBlockFiles,
+		adminSectionAbuseReports,
+		adminSectionEmailReporters,
+		adminSectionIPBans,
+		adminSectionUserBans,
+		adminSectionUserManagement,
+		adminSectionMollieSettlement,
+		adminSectionPayPalTaxes,
+		adminSectionGlobals,
+		adminSectionMaintenance,
+	},
+}
+
+// checkAdminRoles logs a warning for every role in the config which does not
+// exist. Unknown roles don't grant any permissions
+func checkAdminRoles(conf map[string][]string) {
+	for user, roles := range conf {
+		for _, role := range roles {
+			if _, ok := adminRoleSections[adminRole(role)]; !ok {
+				log.Warn("Unknown admin role '%s' configured for user '%s'", role, user)
+			}
+		}
+	}
+}
+
+// adminSections returns the sections of the admin panel which the user is
+// allowed to access. Only users with the admin flag have access. The roles in
+// the admin_roles table limit what those users can do, admins which are not
+// listed are superadmins
+func (wc *WebController) adminSections(user pixelapi.UserInfo) (sections []adminSection) {
+	if !user.IsAdmin {
+		return nil
+	}
+
+	var roles = []adminRole{adminRoleSuperadmin}
+	if conf, ok := wc.config().AdminRoles[user.Username]; ok {
+		roles = nil
+		for _, role := range conf {
+			roles = append(roles, adminRole(role))
+		}
+	}
+
+	var unique = make(map[adminSection]bool)
+	for _, role := range roles {
+		for _, section := range adminRoleSections[role] {
+			unique[section] = true
+		}
+	}
+	for section := range unique {
+		sections = append(sections, section)
+	}
+	sort.Slice(sections, func(i, j int) bool { return sections[i] < sections[j] })
+	return sections
+}
+
+// AdminAllowed returns true if the user is allowed to access the given section
+// of the admin panel
+func (td *TemplateData) AdminAllowed(section adminSection) bool {
+	if section == adminSectionPanel {
+		return len(td.AdminSections) > 0
+	}
+	for _, s := range td.AdminSections {
+		if s == section {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAccess enforces the authentication and authorization requirements of a
+// route. If the user is not allowed to view the page a response is written and
+// false is returned
+func (wc *WebController) checkAccess(w http.ResponseWriter, r *http.Request, td *TemplateData, opts handlerOpts) bool {
+	if (opts.Auth || opts.Admin != "") && !td.Authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return false
+	}
+	if opts.Admin != "" && !td.AdminAllowed(opts.Admin) {
+		wc.serveForbidden(w, r)
+		return false
+	}
+	return true
+}
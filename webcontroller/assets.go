@@ -0,0 +1,133 @@
+package webcontroller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"fornaxian.tech/log"
+)
+
+// assetManifest contains the content hashes of the files in the static
+// resource directory. The hashes are added to asset URLs so the URL changes
+// when the file changes, which allows the files to be cached forever
+type assetManifest struct {
+	dir   string
+	files map[string]assetInfo // Keyed by the path relative to the static dir
+}
+
+type assetInfo struct {
+	hash    string
+	size    int64
+	modTime time.Time
+}
+
+// newAssetManifest hashes all files in the static resource directory. Files
+// which have the same size and modification time as in the previous manifest
+// are not hashed again, this keeps rebuilding the manifest in debug mode cheap
+func newAssetManifest(dir string, prev *assetManifest) (*assetManifest, error) {
+	var m = &assetManifest{dir: dir, files: make(map[string]assetInfo)}
+	if prev != nil && prev.dir != dir {
+		prev = nil
+	}
+
+	var err = filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() {
+			return nil
+		}
+
+		// Precompressed versions of files don't get their own URL
+		for _, ext := range encodingExtensions {
+			if filepath.Ext(file) == ext {
+				return nil
+			}
+		}
+
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		var name = filepath.ToSlash(rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if prev != nil {
+			if old, ok := prev.files[name]; ok && old.size == info.Size() && old.modTime.Equal(info.ModTime()) {
+				m.files[name] = old
+				return nil
+			}
+		}
+
+		hash, err := hashFile(file)
+		if err != nil {
+			return err
+		}
+
+		m.files[name] = assetInfo{hash: hash, size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	return m, err
+}
+
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var h = sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// hash returns the content hash of a static file. The name is relative to the
+// static resource directory
+func (m *assetManifest) hash(name string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	info, ok := m.files[path.Clean("/" + name)[1:]]
+	return info.hash, ok
+}
+
+// loadAssets rebuilds the asset manifest. If the static directory cannot be
+// read the old manifest is kept
+func (tm *TemplateManager) loadAssets() error {
+	var dir = filepath.Join(tm.settings().resourceDir, "static")
+	m, err := newAssetManifest(dir, tm.assets.Load())
+	if err != nil {
+		log.Error("Failed to build asset manifest: %s", err)
+		return err
+	}
+	tm.assets.Store(m)
+	return nil
+}
+
+// assetHash returns the content hash of a file in the static resource
+// directory
+func (tm *TemplateManager) assetHash(name string) (string, bool) {
+	return tm.assets.Load().hash(name)
+}
+
+// asset returns the URL of a static file with its content hash. Files which are
+// not in the manifest get a plain URL, they will be revalidated by the browser
+func (tm *TemplateManager) asset(name string) string {
+	if hash, ok := tm.assetHash(name); ok {
+		return "/res/" + name + "?v=" + hash
+	}
+	log.Debug("Template requested unknown asset '%s'", name)
+	return "/res/" + name
+}
@@ -0,0 +1,103 @@
+package webcontroller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/util"
+)
+
+// etagFor computes a strong ETag from a response body
+func etagFor(body []byte) string {
+	var sum = sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches checks if the ETag matches one of the tags in an If-None-Match
+// header. If-None-Match uses the weak comparison function, so the W/ prefix is
+// ignored. Our own compression middleware turns strong ETags into weak ones
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkETag sets the ETag of the response and checks if the client already has
+// this version. If it does the Not Modified status is written, and the caller
+// should not write anything else
+func checkETag(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// writeCached writes a rendered response with an ETag and cache headers. If the
+// client already has this version of the response only the headers are sent.
+// Private responses are only cached by the browser, public responses can be
+// stored by shared caches. All responses need to be revalidated before they
+// are used, because the content can change at any time. Responses which depend
+// on cookies need to set Vary: Cookie themselves
+func writeCached(w http.ResponseWriter, r *http.Request, body []byte, private bool) {
+	var h = w.Header()
+	if private {
+		h.Set("Cache-Control", "private, no-cache")
+	} else {
+		h.Set("Cache-Control", "public, no-cache")
+	}
+
+	// A HEAD request has no rendered body to compute the ETag from
+	if r.Method == "HEAD" {
+		return
+	}
+
+	if checkETag(w, r, etagFor(body)) {
+		return
+	}
+
+	if _, err := w.Write(body); err != nil && !util.IsNetError(err) {
+		log.Error("Error writing response: %s", err)
+	}
+}
+
+// newPageData returns the template data for a page which is written with
+// writePage. The page is rendered without a CSP nonce, so it's the same for
+// everyone who gets it
+func (wc *WebController) newPageData(w http.ResponseWriter, r *http.Request) *TemplateData {
+	var td = wc.newTemplateData(w, r)
+	td.CSPNonce = ""
+	return td
+}
+
+// writePage writes a page which was rendered with newPageData. Instead of the
+// nonce of the request, the content security policy allows the inline scripts
+// of the page by their hashes. The policy only depends on the page, so pages
+// of visitors who are not logged in can be stored by shared caches
+func (wc *WebController) writePage(w http.ResponseWriter, r *http.Request, body []byte) {
+	if name := wc.cspHeaderName(); name != "" {
+		var hashes = inlineScriptHashes(body)
+		var policy = strings.Replace(
+			w.Header().Get(name),
+			" 'nonce-"+cspNonce(r)+"'",
+			strings.Join(append([]string{""}, hashes...), " "),
+			1,
+		)
+		w.Header().Set(name, policy)
+	}
+
+	// Logged in users see their name in the menu
+	w.Header().Add("Vary", "Cookie")
+	writeCached(w, r, body, wc.personalized(r))
+}
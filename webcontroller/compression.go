@@ -0,0 +1,369 @@
+package webcontroller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fornaxian.tech/log"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings supported by the server, in order of preference
+var contentEncodings = []string{"br", "zstd", "gzip"}
+
+// File extensions which are used for precompressed static files
+var encodingExtensions = map[string]string{
+	"br":   ".br",
+	"zstd": ".zst",
+	"gzip": ".gz",
+}
+
+// negotiateEncoding picks the preferred content encoding which is accepted by
+// the client. An empty string is returned if the client does not accept any of
+// our encodings
+func negotiateEncoding(r *http.Request, available []string) string {
+	var accepted = make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		var name, params, _ = strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(q, 64); err == nil && f <= 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+
+	for _, enc := range available {
+		if accepted[enc] || accepted["*"] {
+			return enc
+		}
+	}
+	return ""
+}
+
+// isCompressible returns true for content types which benefit from compression
+func isCompressible(contentType string) bool {
+	var mediaType, _, _ = strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/json" ||
+		mediaType == "application/javascript" ||
+		mediaType == "application/xml" ||
+		mediaType == "application/toml" ||
+		mediaType == "application/wasm" ||
+		mediaType == "image/svg+xml" ||
+		mediaType == "image/x-icon" ||
+		mediaType == "image/vnd.microsoft.icon" ||
+		mediaType == "font/ttf" ||
+		mediaType == "font/otf"
+}
+
+var (
+	gzipPool   = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+	brotliPool = sync.Pool{New: func() any { return brotli.NewWriterLevel(nil, 4) }}
+	zstdPool   = sync.Pool{New: func() any {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		return enc
+	}}
+)
+
+// compressWriter compresses the response body if the content type is
+// compressible. Like Go's HTTP server the start of the body is buffered so the
+// content type can be detected if the handler did not set it
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	enc      io.WriteCloser
+	status   int    // Status passed to WriteHeader, written when the body starts
+	buf      []byte // Start of the body, used for detecting the content type
+	started  bool
+}
+
+const sniffLen = 512
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.started || cw.status != 0 {
+		return
+	}
+	cw.status = status
+
+	// If the content type is known or the response has no body there is no
+	// need to wait for the body
+	if cw.Header().Get("Content-Type") != "" || !bodyAllowed(status) {
+		cw.start()
+	}
+}
+
+func bodyAllowed(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// start decides whether the response will be compressed and writes the headers
+// and the buffered part of the body
+func (cw *compressWriter) start() {
+	cw.started = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	var h = cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	if bodyAllowed(cw.status) &&
+		h.Get("Content-Encoding") == "" &&
+		h.Get("Content-Range") == "" &&
+		isCompressible(h.Get("Content-Type")) {
+		if length, err := strconv.Atoi(h.Get("Content-Length")); err != nil || length >= 1024 {
+			cw.startEncoder()
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) > 0 {
+		cw.write(cw.buf)
+		cw.buf = nil
+	}
+}
+
+func (cw *compressWriter) startEncoder() {
+	var h = cw.Header()
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+
+	// The compressed body is not byte-for-byte identical to the original, so
+	// a strong ETag is no longer valid
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+
+	switch cw.encoding {
+	case "br":
+		var bw = brotliPool.Get().(*brotli.Writer)
+		bw.Reset(cw.ResponseWriter)
+		cw.enc = bw
+	case "zstd":
+		var zw = zstdPool.Get().(*zstd.Encoder)
+		zw.Reset(cw.ResponseWriter)
+		cw.enc = zw
+	case "gzip":
+		var gw = gzipPool.Get().(*gzip.Writer)
+		gw.Reset(cw.ResponseWriter)
+		cw.enc = gw
+	}
+}
+
+func (cw *compressWriter) write(p []byte) (int, error) {
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.started {
+		return cw.write(p)
+	}
+
+	if cw.Header().Get("Content-Type") != "" {
+		cw.start()
+		return cw.write(p)
+	}
+
+	// Buffer the start of the body until we have enough to detect the type
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= sniffLen {
+		cw.start()
+	}
+	return len(p), nil
+}
+
+// Flush writes the compressed data to the client. This is needed for streaming
+// responses
+func (cw *compressWriter) Flush() {
+	if !cw.started {
+		cw.start()
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes the remaining data, flushes the encoder and returns it to its
+// pool
+func (cw *compressWriter) Close() {
+	if !cw.started && (cw.status != 0 || len(cw.buf) > 0) {
+		cw.start()
+	}
+	if cw.enc == nil {
+		return
+	}
+	cw.enc.Close()
+
+	switch enc := cw.enc.(type) {
+	case *brotli.Writer:
+		brotliPool.Put(enc)
+	case *zstd.Encoder:
+		zstdPool.Put(enc)
+	case *gzip.Writer:
+		gzipPool.Put(enc)
+	}
+	cw.enc = nil
+}
+
+// compressResponse wraps the response writer in a compressing writer if the
+// client supports one of our encodings. The returned function must be called
+// when the response is complete
+func compressResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	var encoding = negotiateEncoding(r, contentEncodings)
+	if encoding == "" || r.Method == "HEAD" {
+		return w, func() {}
+	}
+
+	var cw = &compressWriter{ResponseWriter: w, encoding: encoding}
+	return cw, cw.Close
+}
+
+// serveStaticFile serves a file from the static resource directory. If a
+// precompressed version of the file exists with an encoding which is accepted
+// by the client, that version is served instead
+func serveStaticFile(w http.ResponseWriter, r *http.Request, dir, name string) {
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	// Precompressed files which are older than the original are outdated and
+	// are ignored
+	var available []string
+	if orig, err := os.Stat(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))); err == nil {
+		for _, enc := range contentEncodings {
+			stat, err := os.Stat(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)+encodingExtensions[enc])))
+			if err == nil && !stat.ModTime().Before(orig.ModTime()) {
+				available = append(available, enc)
+			}
+		}
+	}
+
+	if enc := negotiateEncoding(r, available); enc != "" {
+		var file, err = os.Open(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)+encodingExtensions[enc])))
+		if err == nil {
+			defer file.Close()
+
+			// The modification time of the original file is used so the
+			// Last-Modified header does not depend on the encoding
+			if stat, err := os.Stat(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))); err == nil {
+				if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+					w.Header().Set("Content-Type", ct)
+				}
+				w.Header().Set("Content-Encoding", enc)
+
+				// Every encoding of a file needs its own ETag
+				if etag := w.Header().Get("ETag"); strings.HasSuffix(etag, `"`) {
+					w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+enc+`"`)
+				}
+				http.ServeContent(w, r, name, stat.ModTime(), file)
+				return
+			}
+		}
+	}
+
+	r.URL.Path = name
+	http.FileServer(http.Dir(dir)).ServeHTTP(w, r)
+}
+
+// Extensions of the static files which are precompressed by CompressAssets
+var compressibleExtensions = map[string]bool{
+	".js": true, ".css": true, ".svg": true, ".html": true, ".json": true,
+	".txt": true, ".map": true, ".xml": true, ".ttf": true, ".otf": true,
+	".ico": true, ".mjs": true, ".wasm": true,
+}
+
+// CompressAssets creates precompressed versions of the static files in the
+// resource directory. Files are only compressed again if the source file is
+// newer than the compressed version. Compressed files which are not smaller
+// than the original are not kept
+func CompressAssets(resourceDir string) error {
+	return filepath.WalkDir(filepath.Join(resourceDir, "static"), func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() || !compressibleExtensions[filepath.Ext(file)] {
+			return nil
+		}
+
+		src, err := d.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		for _, enc := range contentEncodings {
+			var target = file + encodingExtensions[enc]
+			if stat, err := os.Stat(target); err == nil && !stat.ModTime().Before(src.ModTime()) {
+				continue // Already up to date
+			}
+
+			compressed, err := compressBytes(enc, data)
+			if err != nil {
+				return fmt.Errorf("failed to compress '%s': %w", file, err)
+			}
+			if len(compressed) >= len(data) {
+				os.Remove(target)
+				continue
+			}
+			if err = os.WriteFile(target, compressed, 0644); err != nil {
+				return err
+			}
+			log.Info("Compressed %s (%s): %d -> %d bytes", file, enc, len(data), len(compressed))
+		}
+		return nil
+	})
+}
+
+// compressBytes compresses data with the highest compression level of the
+// encoding. This is slow, so it's only used for precompressing files
+func compressBytes(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var enc io.WriteCloser
+	var err error
+
+	switch encoding {
+	case "br":
+		enc = brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	case "zstd":
+		enc, err = zstd.NewWriter(&buf, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	case "gzip":
+		enc, err = gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	default:
+		err = fmt.Errorf("unknown encoding '%s'", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = enc.Write(data); err != nil {
+		return nil, err
+	}
+	if err = enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
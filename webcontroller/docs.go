@@ -0,0 +1,188 @@
+package webcontroller
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"fornaxian.tech/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The markdown documents in res/include/md are served as documentation pages.
+// A document's URL is its path in the markdown directory without the .md
+// extension, so api/file.md is served on /api/file
+
+// docLink is a link to a documentation page, used for navigation
+type docLink struct {
+	Title    string
+	URL      string
+	Children []docLink
+}
+
+func (wc *WebController) docsIndexPath() string {
+	if index := wc.config().DocsIndex; index != "" {
+		return wc.prefix + index
+	}
+	return wc.prefix + "/docs"
+}
+
+// docURL returns the URL path of a markdown document
+func (wc *WebController) docURL(name string) string {
+	return wc.prefix + wc.config().DocsPrefix + "/" + strings.TrimSuffix(name, ".md")
+}
+
+// docName returns the name of the document which is served on a URL path
+func (wc *WebController) docName(docs map[string]markdownDoc, urlPath string) (string, bool) {
+	name, ok := strings.CutPrefix(path.Clean(urlPath), wc.prefix+wc.config().DocsPrefix+"/")
+	if !ok || name == "" {
+		return "", false
+	}
+	name += ".md"
+
+	if doc, ok := docs[name]; !ok || doc.Meta.Partial {
+		return "", false
+	}
+	return name, true
+}
+
+// registerDocs registers routes for the documents which exist when the server
+// starts. Documents which are added later are served by the not found handler.
+// Documents which are on the same path as another route can't be reached, they
+// are left out of the index
+func (wc *WebController) registerDocs(r *httprouter.Router) {
+	var docs = wc.templates.markdown().docs
+	var paths = []string{wc.docsIndexPath()}
+	for name, doc := range docs {
+		if !doc.Meta.Partial {
+			paths = append(paths, wc.docURL(name))
+		}
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		if handle, _, _ := r.Lookup("GET", p); handle != nil {
+			log.Warn("Documentation page %s is not reachable, the path is used by another route", p)
+			continue
+		}
+		r.GET(p, wc.middleware(wc.serveDocs))
+		r.HEAD(p, wc.middleware(wc.serveDocs))
+		wc.docRoutes[p] = true
+	}
+
+	// Top level documents used to be served without a prefix, like /about.
+	// Those paths redirect to the document when no other route uses them
+	if wc.config().DocsPrefix == "" {
+		return
+	}
+	for name, doc := range docs {
+		var old = wc.prefix + "/" + strings.TrimSuffix(name, ".md")
+		if doc.Meta.Partial || strings.Contains(name, "/") {
+			continue
+		} else if handle, _, _ := r.Lookup("GET", old); handle != nil {
+			continue
+		}
+		var target = wc.docURL(name)
+		r.GET(old, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+		})
+	}
+}
+
+// serveDocs serves the documentation index and documentation pages. Other
+// paths get a 404 page
+func (wc *WebController) serveDocs(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		wc.serveNotFound(w, r)
+		return
+	}
+
+	if path.Clean(r.URL.Path) == wc.docsIndexPath() {
+		wc.serveDocsIndex(w, r)
+		return
+	}
+
+	name, ok := wc.docName(wc.templates.markdown().docs, r.URL.Path)
+	if !ok {
+		wc.serveNotFound(w, r)
+		return
+	}
+	wc.serveMarkdown(name, handlerOpts{})(w, r, p)
+}
+
+func (wc *WebController) serveDocsIndex(w http.ResponseWriter, r *http.Request) {
+	var td = wc.newPageData(w, r)
+	td.Title = "Documentation"
+	td.Other = wc.docsTree(wc.templates.markdown().docs)
+
+	var buf bytes.Buffer
+	if err := wc.templates.Run(&buf, r, "docs_index", td); err != nil {
+		log.Error("Error executing template '%s': %s", "docs_index", err)
+		w.Write(buf.Bytes())
+		return
+	}
+
+	wc.writePage(w, r, buf.Bytes())
+}
+
+// listed returns true if a document should be shown in navigation
+func listed(doc markdownDoc) bool {
+	return !doc.Meta.Partial && !doc.Meta.Unlisted
+}
+
+// docParent returns the name of the document a document is listed under in
+// navigation. That's the document with the same name as the directory the
+// document is in. If that document does not exist the next directory up is
+// tried. Documents without a parent are listed at the root, with an empty name
+func docParent(docs map[string]markdownDoc, name string) string {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if doc, ok := docs[dir+".md"]; ok && listed(doc) {
+			return dir + ".md"
+		}
+	}
+	return ""
+}
+
+// docsTree returns links to all listed documents
+func (wc *WebController) docsTree(docs map[string]markdownDoc) []docLink {
+	return wc.docChildren(docs, "")
+}
+
+// docChildren returns links to the listed documents which are children of a
+// document, sorted by title
+func (wc *WebController) docChildren(docs map[string]markdownDoc, parent string) (links []docLink) {
+	for name, doc := range docs {
+		if !listed(doc) || docParent(docs, name) != parent {
+			continue
+		}
+
+		// A document which can't be reached is left out, its children are
+		// listed in its place
+		if !wc.docReachable(wc.docURL(name)) {
+			links = append(links, wc.docChildren(docs, name)...)
+			continue
+		}
+		links = append(links, docLink{
+			Title:    doc.Title,
+			URL:      wc.docURL(name),
+			Children: wc.docChildren(docs, name),
+		})
+	}
+
+	sort.Slice(links, func(i, j int) bool { return strings.ToLower(links[i].Title) < strings.ToLower(links[j].Title) })
+	return links
+}
+
+// docBreadcrumbs returns links to the documentation index and to the parent
+// documents of a document
+func (wc *WebController) docBreadcrumbs(docs map[string]markdownDoc, name string) []docLink {
+	var links = []docLink{{Title: "Documentation", URL: wc.docsIndexPath()}}
+
+	var parents []docLink
+	for parent := docParent(docs, name); parent != ""; parent = docParent(docs, parent) {
+		parents = append([]docLink{{Title: docs[parent].Title, URL: wc.docURL(parent)}}, parents...)
+	}
+	return append(links, parents...)
+}
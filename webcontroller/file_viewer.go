@@ -5,6 +5,7 @@ import (
 	"html/template"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -12,8 +13,6 @@ import (
 	"fornaxian.tech/pixeldrain_api_client/pixelapi"
 	"fornaxian.tech/util"
 	"github.com/julienschmidt/httprouter"
-	"github.com/microcosm-cc/bluemonday"
-	blackfriday "github.com/russross/blackfriday/v2"
 )
 
 func browserCompat(ua string) bool {
@@ -33,17 +32,20 @@ func (vd *fileViewerData) themeOverride(r *http.Request, files []pixelapi.ListFi
 	vd.ThemeURI = "/theme.css"
 	var theme = r.URL.Query().Get("style")
 	var hue = r.URL.Query().Get("hue")
+	var brand = r.URL.Query().Get("brand")
 
-	if files[0].Branding != nil {
-		if theme == "" {
-			theme = files[0].Branding["theme"]
-		}
+	if files[0].Branding != nil && theme == "" && brand == "" {
+		theme = files[0].Branding["theme"]
+		brand = files[0].Branding["brand_color"]
 		if hue == "" {
 			hue = files[0].Branding["hue"]
 		}
 	}
 
-	if theme != "" {
+	if brand != "" {
+		// A theme generated from the brand colour
+		vd.ThemeURI += template.URL("?brand=" + url.QueryEscape(strings.TrimPrefix(brand, "#")))
+	} else if theme != "" {
 		vd.ThemeURI += template.URL("?style=" + theme)
 		if hue != "" {
 			vd.ThemeURI += template.URL("&hue=" + hue)
@@ -174,7 +176,7 @@ func (wc *WebController) serveListViewer(w http.ResponseWriter, r *http.Request,
 	templateData.OGData = wc.metadataFromList(r, list)
 	var vd = fileViewerData{
 		Type:           "list",
-		CaptchaKey:     wc.captchaSiteKey,
+		CaptchaKey:     wc.captchaKey(),
 		UserAdsEnabled: templateData.User.Subscription.ID == "",
 		APIResponse:    list,
 	}
@@ -206,7 +208,7 @@ func (wc *WebController) serveListViewer(w http.ResponseWriter, r *http.Request,
 
 func (wc *WebController) serveFilePreview(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	apiKey, _ := wc.getAPIKey(r)
-	api := wc.api.Login(apiKey).RealIP(util.RemoteAddress(r)).RealAgent(r.UserAgent())
+	api := wc.api().Login(apiKey).RealIP(util.RemoteAddress(r)).RealAgent(r.UserAgent())
 
 	file, err := api.GetFileInfo(p.ByName("id")) // TODO: Error handling
 	if err != nil {
@@ -236,6 +238,25 @@ func (wc *WebController) serveFilePreview(w http.ResponseWriter, r *http.Request
 			return
 		}
 
-		w.Write(bluemonday.UGCPolicy().SanitizeBytes(blackfriday.Run(bodyBytes)))
+		var html = renderUserMarkdown(bodyBytes)
+
+		// In print mode the document is shown on its own page, in the print
+		// colours of the theme
+		if r.URL.Query().Has("print") {
+			var templateData = wc.newTemplateData(w, r)
+			templateData.Title = file.Name
+			templateData.Other = markdownPage{
+				Title: file.Name,
+				HTML:  html,
+				URL:   getRequestAddress(r) + "/u/" + file.ID,
+			}
+			w.Header().Set("X-Robots-Tag", "noindex")
+			if err = wc.templates.Run(w, r, "markdown_print", templateData); err != nil && !util.IsNetError(err) {
+				log.Error("Error executing template markdown_print: %s", err)
+			}
+			return
+		}
+
+		w.Write([]byte(html))
 	}
 }
@@ -2,10 +2,13 @@ package webcontroller
 
 import (
 	"fmt"
+	"html/template"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
 	"fornaxian.tech/util"
 	"github.com/julienschmidt/httprouter"
 )
@@ -45,8 +48,32 @@ func (wc *WebController) serveDirectory(w http.ResponseWriter, r *http.Request,
 	td.Title = fmt.Sprintf("%s ~ pixeldrain", node.Path[node.BaseIndex].Name)
 	td.Other = node
 	td.OGData = wc.metadataFromFilesystem(r, node)
+	td.ThemeURI = wc.brandThemeURI(node)
 	err = wc.templates.Run(w, r, "filesystem", td)
 	if err != nil && !util.IsNetError(err) {
 		log.Error("Error executing template filesystem: %s", err)
 	}
 }
+
+// brandThemeURI returns the theme of a branded directory. The theme is
+// generated from the highlight colour, or from the header image when no colour
+// is set. The colours set in the branding options are applied on top of it by
+// the filesystem viewer. The path of the header image is signed, so theme.css
+// won't download any other file
+func (wc *WebController) brandThemeURI(f pixelapi.FilesystemPath) template.URL {
+	var uri template.URL
+	for _, node := range f.Path {
+		if node.Properties["branding_enabled"] != "true" {
+			continue
+		}
+		if c := node.Properties["brand_highlight_color"]; c != "" {
+			uri = template.URL("/theme.css?brand=" + url.QueryEscape(strings.TrimPrefix(c, "#")))
+		} else if img := node.Properties["brand_header_image"]; img != "" {
+			uri = template.URL(
+				"/theme.css?brand_image=" + url.QueryEscape(img) +
+					"&sig=" + wc.brandImageSignature(img),
+			)
+		}
+	}
+	return uri
+}
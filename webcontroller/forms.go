@@ -1,8 +1,10 @@
 package webcontroller
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
 	"strings"
 )
@@ -88,17 +90,26 @@ const (
 	FieldTypeNewPassword     FieldType = "new-password"
 	FieldTypeCaptcha         FieldType = "captcha"
 	FieldTypeDescription     FieldType = "description"
+	FieldTypeCheckbox        FieldType = "checkbox"
+	FieldTypeHidden          FieldType = "hidden"
+	FieldTypeFile            FieldType = "file"
 )
 
+// Maximum size of a file which can be uploaded through a form field
+const formFileMaxSize = 1 << 20
+
 // ReadInput reads the form of a request and fills in the values for each field.
 // The return value will be true if this form was submitted and false if the
-// form was not submitted
+// form was not submitted. When an uploaded file can't be read the error is
+// added to the submit messages and false is returned, so the form is shown
+// again
 func (f *Form) ReadInput(r *http.Request) (success bool) {
 	if r.FormValue("form") != f.Name {
 		f.Submitted = false
 		return false
 	}
 	f.Submitted = true
+	success = true
 
 	for i, field := range f.Fields {
 		// Remove carriage returns
@@ -112,10 +123,56 @@ func (f *Form) ReadInput(r *http.Request) (success bool) {
 			field.EnteredValue = r.FormValue("g-recaptcha-response")
 		}
 
+		// The contents of uploaded files are stored in the entered value. The
+		// file is not used as default value, browsers can't prefill those
+		if field.Type == FieldTypeFile {
+			var err error
+			if field.EnteredValue, err = readFormFile(r, field.Name); err != nil {
+				f.SubmitMessages = append(f.SubmitMessages, template.HTML(template.HTMLEscapeString(
+					fmt.Sprintf("%s: %s", field.Label, err),
+				)))
+				success = false
+			}
+			field.DefaultValue = ""
+		}
+
 		f.Fields[i] = field // Update the new values in the array
 	}
 
-	return true
+	return success
+}
+
+// Multipart returns true if this form contains a file field and needs to be
+// submitted with the multipart/form-data encoding
+func (f Form) Multipart() bool {
+	for _, field := range f.Fields {
+		if field.Type == FieldTypeFile {
+			return true
+		}
+	}
+	return false
+}
+
+// readFormFile returns the contents of a file uploaded in a form field. If no
+// file was uploaded the result is empty
+func readFormFile(r *http.Request, name string) (string, error) {
+	file, _, err := r.FormFile(name)
+	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.New("the file could not be read")
+	}
+	defer file.Close()
+
+	// One byte more than the limit is read, so we know if the file is too
+	// large instead of silently cutting it off
+	data, err := io.ReadAll(io.LimitReader(file, formFileMaxSize+1))
+	if err != nil {
+		return "", errors.New("the file could not be read")
+	} else if len(data) > formFileMaxSize {
+		return "", fmt.Errorf("file too large, the maximum size is %d KiB", formFileMaxSize>>10)
+	}
+	return string(data), nil
 }
 
 // FieldVal is a utility function for getting the entered value of a field by
@@ -0,0 +1,404 @@
+package webcontroller
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/util"
+)
+
+// MaintenanceMode controls which parts of the website are available
+type MaintenanceMode string
+
+const (
+	// Everything works normally
+	MaintenanceOff MaintenanceMode = "off"
+
+	// Pages can be viewed, but all requests which change something (form
+	// submissions, uploads through the API proxy) are refused
+	MaintenanceReadOnly MaintenanceMode = "read_only"
+
+	// Every page is replaced by the maintenance page
+	MaintenanceFull MaintenanceMode = "full"
+)
+
+// Announcement is a message which is shown at the top of every page ahead of
+// planned downtime
+type Announcement struct {
+	Message string `toml:"message"`
+
+	// Time window of the planned downtime. The announcement is hidden after
+	// the end time has passed
+	Start time.Time `toml:"start"`
+	End   time.Time `toml:"end"`
+
+	// When the announcement is first shown. If empty the announcement is shown
+	// immediately
+	ShowFrom time.Time `toml:"show_from"`
+}
+
+// Active returns true if the announcement should be shown at the given time
+func (a Announcement) Active(now time.Time) bool {
+	return now.After(a.ShowFrom) && (a.End.IsZero() || now.Before(a.End))
+}
+
+// maintenanceState holds the maintenance settings which can be changed while
+// the server is running
+type maintenanceState struct {
+	mu            sync.RWMutex
+	mode          MaintenanceMode
+	message       string
+	until         time.Time // Expected end of the maintenance, used for Retry-After
+	announcements []Announcement
+
+	// Static settings from the config
+	retryAfter time.Duration
+	bypassIPs  []netip.Prefix
+}
+
+// maintenanceStatus is a snapshot of the maintenance state which is passed to
+// the templates
+type maintenanceStatus struct {
+	Mode          MaintenanceMode
+	Message       string
+	Until         time.Time
+	Announcements []Announcement
+}
+
+func newMaintenanceState(conf Config) *maintenanceState {
+	var m = &maintenanceState{
+		mode:          MaintenanceOff,
+		announcements: conf.Announcements,
+		retryAfter:    time.Duration(conf.MaintenanceRetryAfter) * time.Second,
+	}
+	m.mode = configMaintenanceMode(conf)
+	m.bypassIPs = parseBypassIPs(conf.MaintenanceBypassIPs)
+	return m
+}
+
+func configMaintenanceMode(conf Config) MaintenanceMode {
+	if conf.MaintenanceMode {
+		return MaintenanceFull
+	} else if conf.MaintenanceReadOnly {
+		return MaintenanceReadOnly
+	}
+	return MaintenanceOff
+}
+
+func parseBypassIPs(ips []string) (prefixes []netip.Prefix) {
+	for _, v := range ips {
+		if prefix, err := netip.ParsePrefix(v); err == nil {
+			prefixes = append(prefixes, prefix)
+		} else if addr, err := netip.ParseAddr(v); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		} else {
+			log.Warn("Invalid maintenance bypass address '%s'", v)
+		}
+	}
+	return prefixes
+}
+
+// reload applies the maintenance settings from a new config. The maintenance
+// mode and announcements are only replaced if they were changed in the config,
+// so changes made through the admin panel are not lost
+func (m *maintenanceState) reload(old, conf Config) {
+	var bypassIPs = parseBypassIPs(conf.MaintenanceBypassIPs)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.retryAfter = time.Duration(conf.MaintenanceRetryAfter) * time.Second
+	m.bypassIPs = bypassIPs
+
+	if mode := configMaintenanceMode(conf); mode != configMaintenanceMode(old) {
+		log.Info("Maintenance mode changed from %s to %s", m.mode, mode)
+		m.mode = mode
+		m.message = ""
+		m.until = time.Time{}
+	}
+	if !reflect.DeepEqual(old.Announcements, conf.Announcements) {
+		m.announcements = conf.Announcements
+	}
+}
+
+func (m *maintenanceState) status() maintenanceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var now = time.Now()
+	var s = maintenanceStatus{Mode: m.mode, Message: m.message, Until: m.until}
+	for _, a := range m.announcements {
+		if a.Active(now) {
+			s.Announcements = append(s.Announcements, a)
+		}
+	}
+	return s
+}
+
+// retryAfterSeconds returns the value for the Retry-After header. If the end of
+// the maintenance is known we use that, else the default from the config
+func (m *maintenanceState) retryAfterSeconds() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if until := time.Until(m.until); until > 0 {
+		return int(until.Seconds()) + 1
+	}
+	return int(m.retryAfter.Seconds())
+}
+
+func (m *maintenanceState) bypassIP(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, prefix := range m.bypassIPs {
+		if prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMaintenanceMode changes the maintenance mode of the web server. The
+// message is shown on the maintenance page and the until time is used for the
+// Retry-After header. Both are optional
+func (wc *WebController) SetMaintenanceMode(mode MaintenanceMode, message string, until time.Time) {
+	wc.maintenance.mu.Lock()
+	defer wc.maintenance.mu.Unlock()
+
+	log.Info("Maintenance mode changed from %s to %s", wc.maintenance.mode, mode)
+	wc.maintenance.mode = mode
+	wc.maintenance.message = message
+	wc.maintenance.until = until
+}
+
+// MaintenanceMode returns the current maintenance mode
+func (wc *WebController) MaintenanceMode() MaintenanceMode {
+	wc.maintenance.mu.RLock()
+	defer wc.maintenance.mu.RUnlock()
+	return wc.maintenance.mode
+}
+
+// templateDataKey is the context key of template data which was made before
+// the request reached its handler
+type templateDataKey struct{}
+
+// maintenanceBlocks checks if the request is blocked by the current maintenance
+// mode. If it is, the maintenance page is written to the response and true is
+// returned. The returned request should be passed on to the handler
+func (wc *WebController) maintenanceBlocks(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	var mode = wc.MaintenanceMode()
+	if mode == MaintenanceOff {
+		return r, false
+	} else if mode == MaintenanceReadOnly && isReadOnlyMethod(r.Method) {
+		return r, false
+	} else if wc.maintenance.bypassIP(util.RemoteAddress(r)) {
+		return r, false
+	} else if isLoginRequest(wc.prefix, r) {
+		return r, false
+	}
+
+	// Admins can always use the website. We only check this if the user has a
+	// session cookie, so anonymous requests don't hit the API. The template
+	// data is saved in the request context, so newTemplateData does not have
+	// to look up the user again
+	var td = wc.newTemplateData(w, r)
+	if td.AdminAllowed(adminSectionPanel) {
+		return r.WithContext(context.WithValue(r.Context(), templateDataKey{}, td)), false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(wc.maintenance.retryAfterSeconds()))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	wc.templates.Run(w, r, "maintenance", td)
+	return r, true
+}
+
+// maintenanceBlocksAPI is like maintenanceBlocks, but it writes an API error
+// response instead of the maintenance page. This is used for the API proxy
+func (wc *WebController) maintenanceBlocksAPI(w http.ResponseWriter, r *http.Request) bool {
+	var mode = wc.MaintenanceMode()
+	if mode == MaintenanceOff ||
+		(mode == MaintenanceReadOnly && isReadOnlyMethod(r.Method)) ||
+		wc.maintenance.bypassIP(util.RemoteAddress(r)) {
+		return false
+	}
+
+	// Admins can always use the API, the admin panel needs it. Like in
+	// maintenanceBlocks only requests with a session cookie are checked
+	if key, err := wc.getAPIKey(r); err == nil {
+		user, err := wc.api().RealIP(util.RemoteAddress(r)).RealAgent(r.UserAgent()).Login(key).GetUser()
+		if err == nil && len(wc.adminSections(user)) > 0 {
+			return false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(wc.maintenance.retryAfterSeconds()))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(`{"success":false,"value":"maintenance","message":` +
+		`"Pixeldrain is under maintenance. Please try again later"}`))
+	return true
+}
+
+// isLoginRequest returns true if the request is for the login form. Logging in
+// is always allowed, otherwise admins can't log in to end the maintenance
+func isLoginRequest(prefix string, r *http.Request) bool {
+	return (r.Method == "GET" || r.Method == "POST") && r.URL.Path == prefix+"/login"
+}
+
+func isReadOnlyMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+const maintenanceTimeFormat = "2006-01-02 15:04"
+
+func (wc *WebController) adminMaintenanceForm(td *TemplateData, r *http.Request) (f Form) {
+	if !td.AdminAllowed(adminSectionMaintenance) {
+		return Form{Title: ";-)"}
+	}
+
+	var status = wc.maintenance.status()
+	var until string
+	if !status.Until.IsZero() {
+		until = status.Until.UTC().Format(maintenanceTimeFormat)
+	}
+
+	f = Form{
+		Name:  "admin_maintenance",
+		Title: "Maintenance mode",
+		PreFormHTML: template.HTML(
+			"<p>Admins and allowlisted IP addresses can always use the " +
+				"website. In read-only mode pages can be viewed, but uploads " +
+				"and forms are disabled</p>",
+		),
+		Fields: []Field{
+			{
+				Name:         "mode",
+				Label:        "Mode",
+				DefaultValue: string(status.Mode),
+				Type:         FieldTypeRadio,
+				RadioValues: []string{
+					string(MaintenanceOff),
+					string(MaintenanceReadOnly),
+					string(MaintenanceFull),
+				},
+			}, {
+				Name:         "message",
+				Label:        "Message",
+				DefaultValue: status.Message,
+				Description:  "shown on the maintenance page and in read-only mode",
+				Type:         FieldTypeText,
+			}, {
+				Name:         "until",
+				Label:        "Expected end",
+				DefaultValue: until,
+				Description:  "UTC, format YYYY-MM-DD HH:MM. Used for the Retry-After header",
+				Type:         FieldTypeText,
+			}, {
+				Name:        "announcement",
+				Label:       "Announcement",
+				Description: "schedule a banner which is shown on every page ahead of planned downtime",
+				Type:        FieldTypeText,
+			}, {
+				Name:        "announcement_start",
+				Label:       "Downtime start",
+				Description: "UTC, format YYYY-MM-DD HH:MM",
+				Type:        FieldTypeText,
+			}, {
+				Name:        "announcement_end",
+				Label:       "Downtime end",
+				Description: "UTC, format YYYY-MM-DD HH:MM",
+				Type:        FieldTypeText,
+			}, {
+				Name:        "clear_announcements",
+				Label:       "Clear announcements",
+				Description: "remove all scheduled announcements",
+				Type:        FieldTypeCheckbox,
+			},
+		},
+		SubmitLabel: "Submit",
+		SubmitRed:   true,
+	}
+
+	if f.ReadInput(r) {
+		var parseTime = func(field string) (t time.Time, ok bool) {
+			var val = strings.TrimSpace(f.FieldVal(field))
+			if val == "" {
+				return t, true
+			}
+			t, err := time.Parse(maintenanceTimeFormat, val)
+			if err != nil {
+				f.SubmitMessages = append(f.SubmitMessages, template.HTML(
+					fmt.Sprintf("Invalid time '%s'", template.HTMLEscapeString(val)),
+				))
+				return t, false
+			}
+			return t, true
+		}
+
+		var mode = MaintenanceMode(f.FieldVal("mode"))
+		switch mode {
+		case MaintenanceOff, MaintenanceReadOnly, MaintenanceFull:
+		default:
+			f.SubmitMessages = []template.HTML{"Invalid maintenance mode"}
+			return f
+		}
+
+		untilTime, ok1 := parseTime("until")
+		start, ok2 := parseTime("announcement_start")
+		end, ok3 := parseTime("announcement_end")
+		if !ok1 || !ok2 || !ok3 {
+			return f
+		}
+
+		wc.SetMaintenanceMode(mode, f.FieldVal("message"), untilTime)
+
+		wc.maintenance.mu.Lock()
+		if f.FieldVal("clear_announcements") == "on" {
+			wc.maintenance.announcements = nil
+		}
+		if msg := f.FieldVal("announcement"); msg != "" {
+			wc.maintenance.announcements = append(
+				wc.maintenance.announcements,
+				Announcement{Message: msg, Start: start, End: end},
+			)
+		}
+		wc.maintenance.mu.Unlock()
+
+		f.SubmitSuccess = true
+		f.SubmitMessages = []template.HTML{template.HTML(
+			"Success! Maintenance mode is now " + string(mode),
+		)}
+
+		// Don't fill in the announcement we just added again
+		for i := range f.Fields {
+			if strings.HasPrefix(f.Fields[i].Name, "announcement") ||
+				f.Fields[i].Type == FieldTypeCheckbox {
+				f.Fields[i].DefaultValue = ""
+			}
+		}
+	}
+
+	for _, a := range wc.maintenance.status().Announcements {
+		f.PostFormHTML += template.HTML(fmt.Sprintf(
+			"<p>Scheduled: %s (%s - %s UTC)</p>",
+			template.HTMLEscapeString(a.Message),
+			a.Start.UTC().Format(maintenanceTimeFormat),
+			a.End.UTC().Format(maintenanceTimeFormat),
+		))
+	}
+	return f
+}
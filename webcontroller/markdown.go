@@ -0,0 +1,231 @@
+package webcontroller
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	blackfriday "github.com/russross/blackfriday/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// markdownMeta is the front matter of a markdown document. Front matter is
+// optional, it can be written in YAML between --- lines or in TOML between +++
+// lines at the start of the document
+type markdownMeta struct {
+	Title       string    `yaml:"title" toml:"title"` // Used when the document has no h1
+	Description string    `yaml:"description" toml:"description"`
+	Image       string    `yaml:"image" toml:"image"` // OpenGraph image
+	Keywords    []string  `yaml:"keywords" toml:"keywords"`
+	NoIndex     bool      `yaml:"noindex" toml:"noindex"`
+	Updated     time.Time `yaml:"updated" toml:"updated"`
+
+	// Unlisted documents are not shown in the documentation index. Partial
+	// documents are only used as includes in other documents and don't get a
+	// page of their own
+	Unlisted bool `yaml:"unlisted" toml:"unlisted"`
+	Partial  bool `yaml:"partial" toml:"partial"`
+
+	// Route options, these are combined with the handlerOpts of the route
+	Auth    bool `yaml:"auth" toml:"auth"`
+	NoEmbed bool `yaml:"noembed" toml:"noembed"`
+	NoExec  bool `yaml:"noexec" toml:"noexec"`
+	NoCache bool `yaml:"nocache" toml:"nocache"`
+}
+
+// handlerOpts adds the route options from the front matter to the options of
+// the route. Front matter can only make a route more strict
+func (m markdownMeta) handlerOpts(opts handlerOpts) handlerOpts {
+	opts.Auth = opts.Auth || m.Auth
+	opts.NoEmbed = opts.NoEmbed || m.NoEmbed
+	opts.NoExec = opts.NoExec || m.NoExec
+	opts.NoCache = opts.NoCache || m.NoCache
+	return opts
+}
+
+// markdownDoc is a markdown document from the include directory
+type markdownDoc struct {
+	Meta markdownMeta
+
+	// Title from the front matter or the first h1 of the document. Used for
+	// navigation
+	Title string
+
+	// The document without front matter. Documents with the NoExec option are
+	// not parsed as templates, the body is rendered as is
+	body []byte
+
+	// Modification time of the file. Used in the sitemap when the front
+	// matter has no updated date
+	modTime time.Time
+}
+
+// lastModified returns the date the document was last changed
+func (doc markdownDoc) lastModified() time.Time {
+	if !doc.Meta.Updated.IsZero() {
+		return doc.Meta.Updated
+	}
+	return doc.modTime
+}
+
+// parseMarkdownDoc splits the front matter from a markdown document
+func parseMarkdownDoc(src []byte) (doc markdownDoc, err error) {
+	// Normalize line endings so we only need to look for \n
+	src = bytes.ReplaceAll(src, []byte("\r\n"), []byte("\n"))
+
+	var delim []byte
+	if bytes.HasPrefix(src, []byte("---\n")) {
+		delim = []byte("---")
+	} else if bytes.HasPrefix(src, []byte("+++\n")) {
+		delim = []byte("+++")
+	} else {
+		doc.body = src
+		doc.Title = findTitle(src)
+		return doc, nil
+	}
+
+	var rest = src[len(delim)+1:]
+	var end = bytes.Index(rest, append(append([]byte("\n"), delim...), '\n'))
+	if end == -1 {
+		if !bytes.HasSuffix(rest, append([]byte("\n"), delim...)) {
+			return doc, fmt.Errorf("front matter is not terminated with %s", delim)
+		}
+		end = len(rest) - len(delim) - 1
+	}
+
+	var header = rest[:end]
+	doc.body = rest[min(end+len(delim)+2, len(rest)):]
+
+	if delim[0] == '-' {
+		err = yaml.Unmarshal(header, &doc.Meta)
+	} else {
+		err = toml.Unmarshal(header, &doc.Meta)
+	}
+	if err != nil {
+		return doc, fmt.Errorf("invalid front matter: %w", err)
+	}
+	if doc.Title = findTitle(doc.body); doc.Title == "" {
+		doc.Title = doc.Meta.Title
+	}
+	return doc, nil
+}
+
+// findTitle returns the text of the first level 1 heading in a markdown
+// document
+func findTitle(body []byte) string {
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if title, ok := bytes.CutPrefix(line, []byte("# ")); ok {
+			return string(bytes.TrimSpace(title))
+		}
+	}
+	return ""
+}
+
+// markdownPage is a rendered markdown document
+type markdownPage struct {
+	Title string
+	HTML  template.HTML
+	Meta  markdownMeta
+
+	// Links to the parent and child documents, and the address of the page
+	// which is shown when it's printed. These are not cached with the
+	// rendered document
+	Breadcrumbs []docLink
+	Children    []docLink
+	URL         string
+
+	rendered time.Time
+}
+
+// renderMarkdown converts a markdown document to HTML. The first level 1
+// heading is used as the title of the page and is not included in the HTML. A
+// paragraph containing only the text [TOC] is replaced by the table of contents
+func renderMarkdown(src []byte) (page markdownPage) {
+	renderer := newMarkdownRenderer(blackfriday.HTMLRendererParameters{
+		Flags: blackfriday.CommonHTMLFlags | blackfriday.TOC,
+	})
+
+	// We parse the markdown document, walk through the nodes. Extract the
+	// title of the document, and the rest of the nodes are rendered like
+	// normal
+	var mdBuf bytes.Buffer
+
+	blackfriday.New(
+		blackfriday.WithRenderer(renderer),
+		blackfriday.WithExtensions(markdownExtensions),
+	).Parse(
+		src,
+	).Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		// Capture the title of the document so we can put it at the top of
+		// the template and in the metadata. When entering a h1 node the
+		// first child will be the title of the document. Save that value
+		if node.Type == blackfriday.Heading && node.HeadingData.Level == 1 {
+			page.Title = string(node.FirstChild.Literal)
+			return blackfriday.SkipChildren
+		}
+
+		// If this text node contains solely the text "[TOC]" then we render
+		// the table of contents
+		if node.Type == blackfriday.Text && bytes.Equal(node.Literal, []byte("[TOC]")) {
+			// Find the document node and render its TOC
+			for parent := node.Parent; ; parent = parent.Parent {
+				if parent.Type == blackfriday.Document {
+					renderer.RenderHeader(&mdBuf, parent)
+					return blackfriday.SkipChildren
+				}
+			}
+		}
+
+		return renderer.RenderNode(&mdBuf, node, entering)
+	})
+
+	page.HTML = template.HTML(mdBuf.Bytes())
+	page.rendered = time.Now()
+	return page
+}
+
+// Rendered markdown pages are cached for a while. Most documents only change
+// when the templates are reloaded, which clears the cache. The TTL is for pages
+// which include data from the API, like the Sia price on the hosting page
+const markdownCacheTTL = 10 * time.Minute
+
+// markdownCacheKey identifies a rendered document. Besides the template name
+// only the authentication state is allowed to influence cached documents,
+// pages which use other user data need to opt out of the cache
+type markdownCacheKey struct {
+	template      string
+	authenticated bool
+}
+
+// markdownCache holds the markdown documents which were found while parsing
+// the templates and the rendered versions of those documents. A new cache is
+// created every time the templates are parsed
+type markdownCache struct {
+	docs map[string]markdownDoc // Keyed by template name
+
+	mu    sync.RWMutex
+	pages map[markdownCacheKey]markdownPage
+}
+
+func newMarkdownCache(docs map[string]markdownDoc) *markdownCache {
+	return &markdownCache{docs: docs, pages: make(map[markdownCacheKey]markdownPage)}
+}
+
+func (c *markdownCache) get(key markdownCacheKey) (markdownPage, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	page, ok := c.pages[key]
+	if !ok || time.Since(page.rendered) > markdownCacheTTL {
+		return markdownPage{}, false
+	}
+	return page, true
+}
+
+func (c *markdownCache) put(key markdownCacheKey, page markdownPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pages[key] = page
+}
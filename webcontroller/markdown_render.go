@@ -0,0 +1,243 @@
+package webcontroller
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/microcosm-cc/bluemonday"
+	blackfriday "github.com/russross/blackfriday/v2"
+)
+
+const markdownExtensions = blackfriday.CommonExtensions |
+	blackfriday.AutoHeadingIDs |
+	blackfriday.Footnotes
+
+// markdownRenderer adds some features to the blackfriday HTML renderer:
+//
+//   - Fenced code blocks with a language are highlighted. The highlighter only
+//     sets classes, the colours come from the theme in layout.css
+//   - List items starting with [ ] or [x] get a checkbox
+//   - Block quotes starting with [!NOTE], [!TIP], [!IMPORTANT], [!WARNING] or
+//     [!CAUTION] are rendered as callouts
+//   - Headings get a permalink anchor which is shown on hover
+type markdownRenderer struct {
+	*blackfriday.HTMLRenderer
+
+	headingID string
+	tasks     map[*blackfriday.Node]bool // Text nodes which start a task item
+	callouts  map[*blackfriday.Node]bool
+
+	// When set, task checkboxes are written as this marker followed by x or o
+	// for checked and unchecked. The markers survive sanitizing, they are
+	// replaced with checkboxes afterwards. See renderUserMarkdown
+	taskMarker string
+}
+
+func newMarkdownRenderer(params blackfriday.HTMLRendererParameters) *markdownRenderer {
+	return &markdownRenderer{
+		HTMLRenderer: blackfriday.NewHTMLRenderer(params),
+		tasks:        make(map[*blackfriday.Node]bool),
+		callouts:     make(map[*blackfriday.Node]bool),
+	}
+}
+
+var headingIDRegexp = regexp.MustCompile(`<h[1-6] id="([^"]*)"`)
+
+func (r *markdownRenderer) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	switch node.Type {
+	case blackfriday.CodeBlock:
+		if highlightCode(w, node.Info, node.Literal) {
+			return blackfriday.GoToNext
+		}
+	case blackfriday.Heading:
+		if entering {
+			var buf bytes.Buffer
+			var status = r.HTMLRenderer.RenderNode(&buf, node, entering)
+			r.headingID = ""
+			if m := headingIDRegexp.FindSubmatch(buf.Bytes()); m != nil {
+				r.headingID = string(m[1])
+			}
+			w.Write(buf.Bytes())
+			return status
+		} else if r.headingID != "" {
+			// The anchor has no text, the # is added with CSS. That way it
+			// does not end up in the search index or in copied text
+			fmt.Fprintf(w, `<a class="heading_anchor" href="#%s" aria-label="Link to this section"></a>`, r.headingID)
+		}
+	case blackfriday.Item:
+		if entering && node.ListData.RefLink == nil {
+			if text := taskItemText(node); text != nil {
+				var checked = text.Literal[1] != ' '
+				text.Literal = text.Literal[4:]
+				r.tasks[text] = checked
+				io.WriteString(w, `<li class="task_list_item">`)
+				return blackfriday.GoToNext
+			}
+		}
+	case blackfriday.Text:
+		if checked, ok := r.tasks[node]; ok {
+			if r.taskMarker != "" && checked {
+				io.WriteString(w, r.taskMarker+"x ")
+			} else if r.taskMarker != "" {
+				io.WriteString(w, r.taskMarker+"o ")
+			} else if checked {
+				io.WriteString(w, taskCheckboxChecked+" ")
+			} else {
+				io.WriteString(w, taskCheckbox+" ")
+			}
+		}
+	case blackfriday.BlockQuote:
+		if entering {
+			if kind := calloutKind(node); kind != "" {
+				r.callouts[node] = true
+				fmt.Fprintf(
+					w, "<div class=\"callout callout_%s\">\n<p class=\"callout_title\">%s</p>\n",
+					kind, strings.ToUpper(kind[:1])+kind[1:],
+				)
+				return blackfriday.GoToNext
+			}
+		} else if r.callouts[node] {
+			io.WriteString(w, "</div>\n")
+			return blackfriday.GoToNext
+		}
+	}
+
+	return r.HTMLRenderer.RenderNode(w, node, entering)
+}
+
+// taskItemText returns the text node at the start of a list item if it starts
+// with a task checkbox
+func taskItemText(item *blackfriday.Node) *blackfriday.Node {
+	var text = item.FirstChild
+	if text != nil && text.Type == blackfriday.Paragraph {
+		text = text.FirstChild
+	}
+	if text == nil || text.Type != blackfriday.Text || len(text.Literal) < 4 {
+		return nil
+	}
+	switch string(text.Literal[:4]) {
+	case "[ ] ", "[x] ", "[X] ":
+		return text
+	}
+	return nil
+}
+
+var calloutRegexp = regexp.MustCompile(`^\[!(?i:(note|tip|important|warning|caution))\]\s*`)
+
+// calloutKind returns the kind of callout if a block quote starts with a
+// callout marker. The marker is removed from the document
+func calloutKind(quote *blackfriday.Node) string {
+	var para = quote.FirstChild
+	if para == nil || para.Type != blackfriday.Paragraph {
+		return ""
+	}
+	var text = para.FirstChild
+	if text == nil || text.Type != blackfriday.Text {
+		return ""
+	}
+
+	var m = calloutRegexp.FindSubmatchIndex(text.Literal)
+	if m == nil {
+		return ""
+	}
+	var kind = strings.ToLower(string(text.Literal[m[2]:m[3]]))
+	text.Literal = text.Literal[m[1]:]
+
+	// Remove the line break after the marker, and the paragraph if the marker
+	// was the only thing in it
+	if len(text.Literal) == 0 {
+		if next := text.Next; next != nil && (next.Type == blackfriday.Softbreak || next.Type == blackfriday.Hardbreak) {
+			next.Unlink()
+		}
+		text.Unlink()
+		if para.FirstChild == nil {
+			para.Unlink()
+		}
+	}
+	return kind
+}
+
+var highlightFormatter = chromahtml.New(chromahtml.WithClasses(true), chromahtml.TabWidth(4))
+
+// highlightCode writes a highlighted code block. The first word of the info
+// string is the language. If the language is unknown nothing is written and
+// false is returned
+func highlightCode(w io.Writer, info, code []byte) bool {
+	var lang, _, _ = strings.Cut(string(info), " ")
+	if lang == "" {
+		return false
+	}
+	var lexer = lexers.Get(lang)
+	if lexer == nil {
+		return false
+	}
+
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, string(code))
+	if err != nil {
+		return false
+	}
+	var buf bytes.Buffer
+	if err = highlightFormatter.Format(&buf, styles.Fallback, iterator); err != nil {
+		return false
+	}
+	w.Write(buf.Bytes())
+	return true
+}
+
+const (
+	taskCheckbox        = `<input type="checkbox" disabled>`
+	taskCheckboxChecked = `<input type="checkbox" disabled checked>`
+)
+
+// ugcPolicy is the bluemonday UGC policy with the classes our markdown renderer
+// adds. The short classes are the token classes of the syntax highlighter,
+// those are only allowed on spans. Input elements are not allowed, the task
+// list checkboxes are added after sanitizing
+var ugcPolicy = func() *bluemonday.Policy {
+	var p = bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Matching(regexp.MustCompile(
+		`^(chroma|task_list_item|heading_anchor|footnotes|footnote-ref|footnote-return|` +
+			`callout|callout_(title|note|tip|important|warning|caution))( callout_[a-z]+)?$`,
+	)).Globally()
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^(line|cl|[a-z][a-z0-9]{0,2})$`)).OnElements("span")
+	return p
+}()
+
+// renderUserMarkdown renders a markdown file uploaded by a user. All headings
+// are kept. Heading IDs are prefixed so they can't clash with the IDs on our
+// own pages, and the output is sanitized. Users can't add input elements with
+// raw HTML, the checkboxes of task lists are marked with a random string which
+// can't be guessed and replaced after sanitizing
+func renderUserMarkdown(src []byte) template.HTML {
+	var marker [8]byte
+	if _, err := rand.Read(marker[:]); err != nil {
+		panic(err)
+	}
+
+	var renderer = newMarkdownRenderer(blackfriday.HTMLRendererParameters{
+		Flags:                blackfriday.CommonHTMLFlags,
+		HeadingIDPrefix:      "user-content-",
+		FootnoteAnchorPrefix: "user-content-",
+	})
+	renderer.taskMarker = "task" + hex.EncodeToString(marker[:])
+	var html = blackfriday.Run(
+		src,
+		blackfriday.WithRenderer(renderer),
+		blackfriday.WithExtensions(markdownExtensions),
+	)
+
+	html = ugcPolicy.SanitizeBytes(html)
+	html = bytes.ReplaceAll(html, []byte(renderer.taskMarker+"x"), []byte(taskCheckboxChecked))
+	html = bytes.ReplaceAll(html, []byte(renderer.taskMarker+"o"), []byte(taskCheckbox))
+	return template.HTML(html)
+}
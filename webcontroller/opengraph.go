@@ -4,12 +4,15 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"fornaxian.tech/pixeldrain_api_client/pixelapi"
 )
 
 const defaultThemeColour = "#220735"
 const defaultHost = "https://pixeldrain.com"
+const defaultDescription = "Instant file and screenshot sharing."
+const defaultImage = "/res/img/pixeldrain_256.png"
 
 type ogData struct {
 	MetaPropRules []ogProp
@@ -153,3 +156,41 @@ func (wc *WebController) metadataFromFilesystem(r *http.Request, f pixelapi.File
 		colour,
 	)
 }
+
+func (wc *WebController) metadataFromMarkdown(r *http.Request, page markdownPage) (og ogData) {
+	var addr = getRequestAddress(r)
+
+	var description = page.Meta.Description
+	if description == "" {
+		description = defaultDescription
+	}
+	var image = page.Meta.Image
+	if image == "" {
+		image = defaultImage
+	}
+	if strings.HasPrefix(image, "/") {
+		image = addr + image
+	}
+
+	og.addProp("og:type", "article")
+	og.addProp("og:title", page.Title+" ~ pixeldrain")
+	og.addProp("og:site_name", "pixeldrain")
+	og.addProp("og:description", description)
+	og.addProp("og:url", addr+r.URL.Path)
+	og.addProp("og:image", image)
+	if !page.Meta.Updated.IsZero() {
+		og.addProp("article:modified_time", page.Meta.Updated.Format(time.RFC3339))
+	}
+	og.addName("description", description)
+	if len(page.Meta.Keywords) > 0 {
+		og.addName("keywords", strings.Join(page.Meta.Keywords, ", "))
+	}
+	if page.Meta.NoIndex {
+		og.addName("robots", "noindex")
+	}
+	og.addName("twitter:card", "summary")
+	og.addName("twitter:title", page.Title)
+	og.addName("twitter:site", "@Fornax96")
+	og.addName("twitter:image", image)
+	return og
+}
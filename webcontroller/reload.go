@@ -0,0 +1,89 @@
+package webcontroller
+
+import (
+	"fmt"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+)
+
+// runtimeConfig contains the parts of the web controller which depend on the
+// configuration. It is swapped atomically when the configuration is reloaded,
+// so requests which are in progress keep using the old values
+type runtimeConfig struct {
+	conf Config
+
+	// API client to use for all requests. If the user is authenticated you
+	// should call Login() on this object. Calling Login will create a copy and
+	// not alter the original PixelAPI, but it will use the same HTTP Transport
+	api pixelapi.PixelAPI
+
+	// Reverse proxy for API requests. Nil if proxying is disabled
+	proxy    *httputil.ReverseProxy
+	proxyURL *url.URL
+
+	// Site key for reCAPTCHA, fetched from the API on first use. Nil until
+	// it's fetched, "none" if captchas are disabled
+	captchaSiteKey atomic.Pointer[string]
+}
+
+func (wc *WebController) newRuntimeConfig(conf Config) (rc *runtimeConfig, err error) {
+	rc = &runtimeConfig{
+		conf: conf,
+		api:  pixelapi.New(conf.APIURLInternal),
+	}
+
+	if conf.APISocketPath != "" {
+		rc.api = rc.api.UnixSocketPath(conf.APISocketPath)
+	}
+
+	if conf.ProxyAPIRequests {
+		rc.proxyURL, err = url.Parse(strings.TrimSuffix(conf.APIURLInternal, "/api"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse reverse proxy URL '%s': %w", conf.APIURLInternal, err)
+		}
+
+		rc.proxy = httputil.NewSingleHostReverseProxy(rc.proxyURL)
+		rc.proxy.Transport = wc.httpClient.Transport
+	}
+	return rc, nil
+}
+
+// config returns the active configuration
+func (wc *WebController) config() Config { return wc.runtime.Load().conf }
+
+// api returns the API client for the active configuration
+func (wc *WebController) api() pixelapi.PixelAPI { return wc.runtime.Load().api }
+
+// Reload applies a new configuration to the running web server. The API client,
+// proxy target, templates, themes, background patterns, admin roles and
+// maintenance settings are replaced and the search index is rebuilt.
+// If the new configuration can't be applied an error is returned and the old
+// configuration stays active
+func (wc *WebController) Reload(conf Config) error {
+	rc, err := wc.newRuntimeConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	if err = wc.templates.Reload(conf.ResourceDir, conf.APIURLExternal, wc.prefix+conf.DocsPrefix, conf.DebugMode); err != nil {
+		return fmt.Errorf("failed to parse templates: %w", err)
+	}
+
+	var old = wc.runtime.Swap(rc)
+
+	if conf.ProxyAPIRequests && !wc.proxyRegistered {
+		log.Warn("API proxy was disabled at startup, enabling it requires a restart")
+	}
+
+	wc.loadThemes()
+	wc.loadPatterns()
+	checkAdminRoles(conf.AdminRoles)
+	wc.maintenance.reload(old.conf, conf)
+	go wc.buildSearchIndex()
+	return nil
+}
@@ -0,0 +1,400 @@
+package webcontroller
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"fornaxian.tech/log"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/html"
+)
+
+// searchSection is a part of a documentation page, from one heading to the
+// next. Search results link to the heading of the section
+type searchSection struct {
+	DocTitle string
+	Heading  string
+	URL      string
+
+	text string
+}
+
+type searchPosting struct {
+	section int
+	count   int
+}
+
+// searchIndex is an inverted index of the words in the documentation pages
+type searchIndex struct {
+	sections []searchSection
+	terms    map[string][]searchPosting
+}
+
+type searchResult struct {
+	searchSection
+	Snippet template.HTML
+	score   float64
+}
+
+// tokenize splits text into lowercase words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// sectionsFromHTML splits a rendered markdown document on its headings. The
+// table of contents is skipped, it only repeats the headings
+func sectionsFromHTML(page template.HTML, docTitle, docURL string) (sections []searchSection) {
+	var section = searchSection{DocTitle: docTitle, Heading: docTitle, URL: docURL}
+	var text, heading strings.Builder
+	var inHeading, inNav bool
+
+	var flush = func() {
+		section.text = strings.Join(strings.Fields(text.String()), " ")
+		if section.text != "" {
+			sections = append(sections, section)
+		}
+		text.Reset()
+	}
+
+	var z = html.NewTokenizer(strings.NewReader(string(page)))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			flush()
+			return sections
+		case html.StartTagToken:
+			var tag, hasAttr = z.TagName()
+			switch string(tag) {
+			case "nav":
+				inNav = true
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				flush()
+				inHeading = true
+				heading.Reset()
+				section = searchSection{DocTitle: docTitle, URL: docURL}
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					if string(key) == "id" {
+						section.URL = docURL + "#" + string(val)
+					}
+				}
+			}
+		case html.EndTagToken:
+			var tag, _ = z.TagName()
+			switch string(tag) {
+			case "nav":
+				inNav = false
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				inHeading = false
+				section.Heading = strings.TrimSpace(heading.String())
+			}
+		case html.TextToken:
+			if inNav {
+				continue
+			} else if inHeading {
+				heading.Write(z.Text())
+			} else {
+				text.Write(z.Text())
+				text.WriteByte(' ')
+			}
+		}
+	}
+}
+
+func newSearchIndex(sections []searchSection) *searchIndex {
+	var idx = &searchIndex{sections: sections, terms: make(map[string][]searchPosting)}
+	for i, section := range sections {
+		var counts = make(map[string]int)
+		for _, term := range tokenize(section.Heading + " " + section.text) {
+			counts[term]++
+		}
+		for term, count := range counts {
+			idx.terms[term] = append(idx.terms[term], searchPosting{section: i, count: count})
+		}
+	}
+	return idx
+}
+
+// search returns the sections which contain all words in the query, best
+// matches first. The last word of the query also matches words which start
+// with it, so results can be shown while the user is typing
+func (idx *searchIndex) search(query string, limit int) (results []searchResult) {
+	var terms = tokenize(query)
+	if idx == nil || len(terms) == 0 {
+		return nil
+	}
+
+	var scores = make(map[int]float64)
+	for i, term := range terms {
+		var matches = []string{term}
+		if i == len(terms)-1 {
+			matches = matches[:0]
+			for t := range idx.terms {
+				if strings.HasPrefix(t, term) {
+					matches = append(matches, t)
+				}
+			}
+		}
+
+		var termScores = make(map[int]float64)
+		for _, match := range matches {
+			var postings = idx.terms[match]
+			var idf = math.Log(1 + float64(len(idx.sections))/float64(len(postings)))
+			for _, p := range postings {
+				termScores[p.section] += float64(p.count) * idf
+				if strings.Contains(strings.ToLower(idx.sections[p.section].Heading), match) {
+					termScores[p.section] += 5 * idf
+				}
+			}
+		}
+
+		// Only keep sections which match every term
+		for section, score := range termScores {
+			if i == 0 {
+				scores[section] = score
+			} else if _, ok := scores[section]; ok {
+				scores[section] += score
+			}
+		}
+		for section := range scores {
+			if _, ok := termScores[section]; !ok {
+				delete(scores, section)
+			}
+		}
+	}
+
+	for section, score := range scores {
+		results = append(results, searchResult{searchSection: idx.sections[section], score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].URL < results[j].URL
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	var highlight = newHighlighter(terms)
+	for i := range results {
+		results[i].Snippet = snippet(results[i].text, highlight)
+	}
+	return results
+}
+
+// highlighter finds the search terms in text. The last term also matches words
+// starting with it
+type highlighter struct {
+	words  *regexp.Regexp
+	terms  map[string]bool
+	prefix string
+}
+
+func newHighlighter(terms []string) *highlighter {
+	var h = &highlighter{terms: make(map[string]bool), prefix: terms[len(terms)-1]}
+	var quoted = make([]string, len(terms))
+	for i, term := range terms {
+		h.terms[term] = true
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+
+	// Go's regexp has no lookahead and \b only knows ASCII word characters.
+	// So the regexp matches whole words starting with one of the terms, and
+	// the words which are not a term are filtered out afterwards
+	h.words = regexp.MustCompile(`(?i)(?:^|[^\pL\pN])((?:` + strings.Join(quoted, "|") + `)[\pL\pN]*)`)
+	return h
+}
+
+// find returns the locations of at most n matches in text, all matches if n is
+// negative
+func (h *highlighter) find(text string, n int) (locs [][]int) {
+	for _, loc := range h.words.FindAllStringSubmatchIndex(text, -1) {
+		if n >= 0 && len(locs) >= n {
+			break
+		}
+		var word = strings.ToLower(text[loc[2]:loc[3]])
+		if h.terms[word] || strings.HasPrefix(word, h.prefix) {
+			locs = append(locs, loc[2:4])
+		}
+	}
+	return locs
+}
+
+// snippet returns the part of the text around the first match, with all
+// matches wrapped in mark tags
+func snippet(text string, highlight *highlighter) template.HTML {
+	const radius = 80
+
+	var start, end = 0, len(text)
+	if locs := highlight.find(text, 1); locs != nil {
+		var loc = locs[0]
+		start = max(loc[0]-radius, 0)
+		end = min(loc[1]+radius, len(text))
+	} else {
+		end = min(2*radius, len(text))
+	}
+
+	// Don't cut multi-byte characters in half
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	// Cut the snippet on word boundaries
+	if start > 0 {
+		if i := strings.IndexByte(text[start:], ' '); i != -1 && start+i < end {
+			start += i + 1
+		}
+	}
+	if end < len(text) {
+		if i := strings.LastIndexByte(text[start:end], ' '); i > 0 {
+			end = start + i
+		}
+	}
+
+	var buf strings.Builder
+	if start > 0 {
+		buf.WriteString("… ")
+	}
+	var part = text[start:end]
+	var last = 0
+	for _, loc := range highlight.find(part, -1) {
+		buf.WriteString(template.HTMLEscapeString(part[last:loc[0]]))
+		buf.WriteString("<mark>" + template.HTMLEscapeString(part[loc[0]:loc[1]]) + "</mark>")
+		last = loc[1]
+	}
+	buf.WriteString(template.HTMLEscapeString(part[last:]))
+	if end < len(text) {
+		buf.WriteString(" …")
+	}
+	return template.HTML(buf.String())
+}
+
+// includeRegexp matches template actions which include another document
+var includeRegexp = regexp.MustCompile(`{{-?\s*template\s+"([^"]+)"`)
+
+// includedDocs returns the names of the documents which are included in
+// another document
+func includedDocs(docs map[string]markdownDoc) map[string]bool {
+	var included = make(map[string]bool)
+	for _, doc := range docs {
+		if doc.Meta.NoExec {
+			continue
+		}
+		for _, match := range includeRegexp.FindAllSubmatch(doc.body, -1) {
+			included[string(match[1])] = true
+		}
+	}
+	return included
+}
+
+// buildSearchIndex renders all public documentation pages and indexes them.
+// Pages which require a login, are unlisted or should not be indexed are left
+// out. Documents which are included in another document are only indexed as
+// part of that document, so their text is not found twice
+func (wc *WebController) buildSearchIndex() {
+	// The documents and templates have to come from the same reload
+	var state = wc.templates.state.Load()
+	var docs, tpl = state.markdown.docs, state.tpl
+	var td = &TemplateData{
+		tpm:         wc.templates,
+		APIEndpoint: template.URL(wc.config().APIURLExternal),
+		PixelAPI:    wc.api(),
+		Hostname:    template.HTML(wc.hostname),
+		URLQuery:    url.Values{},
+	}
+
+	var included = includedDocs(docs)
+	var sections []searchSection
+	for name, doc := range docs {
+		if !listed(doc) || doc.Meta.NoIndex || doc.Meta.Auth || included[name] {
+			continue
+		}
+
+		var src = doc.body
+		if !doc.Meta.NoExec {
+			var buf bytes.Buffer
+			if err := tpl.ExecuteTemplate(&buf, name, td); err != nil {
+				log.Warn("Failed to index document '%s': %s", name, err)
+				continue
+			}
+			src = buf.Bytes()
+		}
+
+		var page = renderMarkdown(src)
+		if page.Title == "" {
+			page.Title = doc.Title
+		}
+		sections = append(sections, sectionsFromHTML(page.HTML, page.Title, wc.docURL(name))...)
+	}
+
+	wc.search.Store(newSearchIndex(sections))
+	log.Debug("Indexed %d documentation sections for search", len(sections))
+}
+
+// searchIndex returns the search index. In debug mode the templates are parsed
+// again on every request, the index is rebuilt as well so it shows the
+// documents as they are on disk
+func (wc *WebController) searchIndex() *searchIndex {
+	if wc.templates.debugMode() {
+		if err := wc.templates.ParseTemplates(true); err != nil {
+			log.Warn("Failed to parse templates: %s", err)
+		}
+		wc.buildSearchIndex()
+	}
+	return wc.search.Load()
+}
+
+func (wc *WebController) serveSearch(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newPageData(w, r)
+	var query = r.URL.Query().Get("q")
+	td.Title = "Search"
+	if query != "" {
+		td.Title = "Search results for " + query
+	}
+	td.Other = wc.searchIndex().search(query, 50)
+
+	var buf bytes.Buffer
+	if err := wc.templates.Run(&buf, r, "search", td); err != nil {
+		log.Error("Error executing template '%s': %s", "search", err)
+		w.Write(buf.Bytes())
+		return
+	}
+	wc.writePage(w, r, buf.Bytes())
+}
+
+// serveSearchJSON returns a few search results for typeahead suggestions
+func (wc *WebController) serveSearchJSON(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type suggestion struct {
+		Title   string `json:"title"`
+		Heading string `json:"heading"`
+		URL     string `json:"url"`
+	}
+	var suggestions = []suggestion{}
+	for _, res := range wc.searchIndex().search(r.URL.Query().Get("q"), 8) {
+		suggestions = append(suggestions, suggestion{Title: res.DocTitle, Heading: res.Heading, URL: res.URL})
+	}
+
+	body, err := json.Marshal(suggestions)
+	if err != nil {
+		log.Error("Failed to encode search suggestions: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeCached(w, r, body, false)
+}
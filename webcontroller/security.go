@@ -0,0 +1,255 @@
+package webcontroller
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/util"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/html"
+)
+
+// CSP modes for the csp_mode config option
+const (
+	CSPOff        = "off"
+	CSPReportOnly = "report_only"
+	CSPEnforce    = "enforce"
+)
+
+// cspReportPath is the endpoint which collects CSP violation reports
+const cspReportPath = "/csp-report"
+
+// baseCSP is the content security policy which is applied to every page. The
+// nonce for inline scripts, the frame-ancestors directive and the sources from
+// the config are added when the header is generated
+var baseCSP = map[string][]string{
+	"default-src":     {"'self'"},
+	"script-src":      {"'self'"},
+	"style-src":       {"'self'", "'unsafe-inline'"}, // Svelte components inject styles
+	"img-src":         {"'self'", "data:", "blob:"},
+	"media-src":       {"'self'", "blob:"},
+	"font-src":        {"'self'"},
+	"connect-src":     {"'self'"},
+	"frame-src":       {"'self'"},
+	"object-src":      {"'none'"},
+	"base-uri":        {"'self'"},
+	"form-action":     {"'self'"},
+	"frame-ancestors": {"*"},
+}
+
+type nonceKey struct{}
+
+// cspNonce returns the nonce which was generated for this request. Inline
+// scripts need to have this nonce to be executed
+func cspNonce(r *http.Request) string {
+	if nonce, ok := r.Context().Value(nonceKey{}).(string); ok {
+		return nonce
+	}
+	return ""
+}
+
+func newNonce() string {
+	var buf [18]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf[:])
+}
+
+// contentSecurityPolicy builds the CSP header value for a request
+func (wc *WebController) contentSecurityPolicy(r *http.Request, frameAncestors ...string) string {
+	var conf = wc.config()
+	var directives = make(map[string][]string, len(baseCSP))
+	for k, v := range baseCSP {
+		directives[k] = append([]string(nil), v...)
+	}
+
+	// If the API is on a different domain the browser needs to be able to
+	// connect to it
+	if strings.HasPrefix(conf.APIURLExternal, "http") || strings.HasPrefix(conf.APIURLExternal, "//") {
+		directives["connect-src"] = append(directives["connect-src"], conf.APIURLExternal)
+		directives["img-src"] = append(directives["img-src"], conf.APIURLExternal)
+		directives["media-src"] = append(directives["media-src"], conf.APIURLExternal)
+	}
+	for k, v := range conf.CSPSources {
+		directives[k] = append(directives[k], v...)
+	}
+	if nonce := cspNonce(r); nonce != "" {
+		directives["script-src"] = append(directives["script-src"], "'nonce-"+nonce+"'")
+	}
+	if len(frameAncestors) > 0 {
+		directives["frame-ancestors"] = frameAncestors
+	}
+
+	var keys = make([]string, 0, len(directives))
+	for k := range directives {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var policy strings.Builder
+	for _, k := range keys {
+		policy.WriteString(k + " " + strings.Join(directives[k], " ") + "; ")
+	}
+	policy.WriteString("report-uri " + cspReportPath)
+	return policy.String()
+}
+
+func (wc *WebController) cspHeaderName() string {
+	switch wc.config().CSPMode {
+	case CSPEnforce:
+		return "Content-Security-Policy"
+	case CSPReportOnly:
+		return "Content-Security-Policy-Report-Only"
+	default:
+		return ""
+	}
+}
+
+// setSecurityHeaders generates a nonce for the request and sets the security
+// headers from the config. The request with the nonce in its context is
+// returned
+func (wc *WebController) setSecurityHeaders(w http.ResponseWriter, r *http.Request) *http.Request {
+	var conf = wc.config()
+	var h = w.Header()
+
+	h.Set("X-Content-Type-Options", "nosniff")
+	if conf.ReferrerPolicy != "" {
+		h.Set("Referrer-Policy", conf.ReferrerPolicy)
+	}
+	if conf.PermissionsPolicy != "" {
+		h.Set("Permissions-Policy", conf.PermissionsPolicy)
+	}
+	if conf.CrossOriginOpenerPolicy != "" {
+		h.Set("Cross-Origin-Opener-Policy", conf.CrossOriginOpenerPolicy)
+	}
+
+	if name := wc.cspHeaderName(); name != "" {
+		r = r.WithContext(context.WithValue(r.Context(), nonceKey{}, newNonce()))
+		h.Set(name, wc.contentSecurityPolicy(r))
+	}
+	return r
+}
+
+// denyEmbedding prevents the page from being embedded in a frame on another
+// website
+func (wc *WebController) denyEmbedding(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Frame-Options", "DENY")
+	if name := wc.cspHeaderName(); name != "" {
+		w.Header().Set(name, wc.contentSecurityPolicy(r, "'none'"))
+	}
+}
+
+// Number of CSP reports logged in the current minute. This prevents a broken
+// page from flooding the logs
+var (
+	cspReportCount  atomic.Int64
+	cspReportMinute atomic.Int64
+)
+
+const cspReportsPerMinute = 100
+
+// cspReport is the legacy report format sent for the report-uri directive
+type cspReport struct {
+	Report struct {
+		DocumentURI        string `json:"document-uri"`
+		BlockedURI         string `json:"blocked-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+		Disposition        string `json:"disposition"`
+	} `json:"csp-report"`
+}
+
+func (wc *WebController) serveCSPReport(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	// Reports don't need a response body
+	defer w.WriteHeader(http.StatusNoContent)
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		return
+	}
+
+	var report cspReport
+	if err = json.Unmarshal(body, &report); err != nil {
+		log.Debug("Invalid CSP report from %s: %s", util.RemoteAddress(r), err)
+		return
+	}
+
+	var minute = time.Now().Unix() / 60
+	if cspReportMinute.Swap(minute) != minute {
+		cspReportCount.Store(0)
+	}
+	if cspReportCount.Add(1) > cspReportsPerMinute {
+		return
+	}
+
+	log.Warn(
+		"CSP violation (%s) on %s: %s blocked by %s (%s:%d)",
+		report.Report.Disposition,
+		report.Report.DocumentURI,
+		report.Report.BlockedURI,
+		report.Report.EffectiveDirective,
+		report.Report.SourceFile,
+		report.Report.LineNumber,
+	)
+}
+
+// inlineScriptHashes returns the CSP hash sources of the inline scripts in a
+// HTML page
+func inlineScriptHashes(page []byte) (hashes []string) {
+	var seen = make(map[string]bool)
+	var inScript bool
+	var z = html.NewTokenizer(bytes.NewReader(page))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return hashes
+		case html.StartTagToken:
+			name, hasAttr := z.TagName()
+			inScript = string(name) == "script"
+			for hasAttr {
+				var key []byte
+				key, _, hasAttr = z.TagAttr()
+				if string(key) == "src" {
+					inScript = false
+				}
+			}
+		case html.TextToken:
+			if !inScript {
+				continue
+			}
+			var sum = sha256.Sum256(z.Raw())
+			var hash = "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+			if !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+		case html.EndTagToken:
+			inScript = false
+		}
+	}
+}
+
+// nonceAttr is a template function which returns the nonce attribute for an
+// inline script tag. It should be called with the template data as argument
+func (tm *TemplateManager) nonceAttr(data any) template.HTMLAttr {
+	td, ok := data.(*TemplateData)
+	if !ok || td.CSPNonce == "" {
+		return ""
+	}
+	return template.HTMLAttr(`nonce="` + td.CSPNonce + `"`)
+}
@@ -0,0 +1,119 @@
+package webcontroller
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"fornaxian.tech/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+func sitemapDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// templatesModified returns the modification time of the most recently changed
+// template. The pages from the route table are rendered from several templates,
+// so any change can affect them
+func templatesModified(resourceDir string) (modified time.Time) {
+	filepath.WalkDir(resourceDir+"/template", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+		return nil
+	})
+	return modified
+}
+
+// docReachable returns false if the path of a document is taken by another
+// route
+func (wc *WebController) docReachable(urlPath string) bool {
+	if wc.docRoutes[urlPath] {
+		return true
+	}
+	handle, _, _ := wc.router.Lookup("GET", urlPath)
+	return handle == nil
+}
+
+// serveSitemap lists the public pages from the route table and the
+// documentation pages which may be indexed
+func (wc *WebController) serveSitemap(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var addr = getRequestAddress(r)
+	var urlSet = sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+
+	var pagesModified = sitemapDate(templatesModified(wc.config().ResourceDir))
+	for _, page := range wc.sitemapPaths {
+		urlSet.URLs = append(urlSet.URLs, sitemapURL{Loc: addr + wc.prefix + "/" + page, LastMod: pagesModified})
+	}
+
+	var docs = wc.templates.markdown().docs
+	var docURLs []sitemapURL
+	var docsModified time.Time
+	for name, doc := range docs {
+		if doc.Meta.Partial || doc.Meta.NoIndex || doc.Meta.Auth || !wc.docReachable(wc.docURL(name)) {
+			continue
+		}
+		docURLs = append(docURLs, sitemapURL{Loc: addr + wc.docURL(name), LastMod: sitemapDate(doc.lastModified())})
+		if listed(doc) && doc.lastModified().After(docsModified) {
+			docsModified = doc.lastModified()
+		}
+	}
+	sort.Slice(docURLs, func(i, j int) bool { return docURLs[i].Loc < docURLs[j].Loc })
+
+	// The index changes when one of the listed documents changes
+	if wc.docReachable(wc.docsIndexPath()) {
+		urlSet.URLs = append(urlSet.URLs, sitemapURL{Loc: addr + wc.docsIndexPath(), LastMod: sitemapDate(docsModified)})
+	}
+	urlSet.URLs = append(urlSet.URLs, docURLs...)
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(urlSet); err != nil {
+		log.Error("Failed to encode sitemap: %s", err)
+		http.Error(w, "Failed to encode sitemap", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	writeCached(w, r, buf.Bytes(), false)
+}
+
+// serveRobots generates robots.txt from the config. The sitemap is linked so
+// crawlers can find the documentation pages
+func (wc *WebController) serveRobots(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var buf bytes.Buffer
+	buf.WriteString("# Go ahead robots, do your worst\n")
+	buf.WriteString("User-agent: *\n")
+	for _, path := range wc.config().RobotsDisallow {
+		buf.WriteString("Disallow: " + wc.prefix + path + "\n")
+	}
+	if len(wc.config().RobotsDisallow) == 0 {
+		buf.WriteString("Disallow:\n")
+	}
+	buf.WriteString("\nSitemap: " + getRequestAddress(r) + wc.prefix + "/sitemap.xml\n")
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeCached(w, r, buf.Bytes(), false)
+}
@@ -2,21 +2,75 @@ package webcontroller
 
 import (
 	"fmt"
-	"html/template"
-	"math/rand"
 	"net/http"
 	"strconv"
-	"time"
+	"strings"
 
+	"fornaxian.tech/log"
 	"github.com/julienschmidt/httprouter"
 )
 
 func (wc *WebController) themeHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	t, err := wc.themeFromRequest(r)
+	if err != nil {
+		// The appearance page shows this error when previewing a custom theme,
+		// and branding previews with the preview parameter
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/css")
-	w.Write([]byte(userStyleFromRequest(r)))
+
+	// Pages in print mode use the print style sheet on screen as well
+	var css = t.css()
+	if r.URL.Query().Has("print") {
+		css = t.printCSS()
+	}
+
+	// The style only depends on the URL and the style cookies, it does not
+	// contain any personal information
+	varyThemeCookies(w, r)
+	writeCached(w, r, []byte(css), false)
 }
 
-func userStyleFromRequest(r *http.Request) (s template.CSS) {
+// varyThemeCookies adds Vary: Cookie to the response if themeFromRequest reads
+// the style cookies for this request. That's when the style or the hue is not
+// in the URL, or when a custom theme is not in the URL
+func varyThemeCookies(w http.ResponseWriter, r *http.Request) {
+	var q = r.URL.Query()
+	if q.Get("style") == "" || q.Get("hue") == "" || (q.Get("style") == "custom" && q.Get("theme") == "") {
+		w.Header().Add("Vary", "Cookie")
+	}
+}
+
+// themeFromRequest returns the theme chosen with the URL parameters or the
+// style cookies
+func (wc *WebController) themeFromRequest(r *http.Request) (t resolvedTheme, err error) {
+	var themes = wc.themes.Load()
+
+	// Branded pages get a theme generated from the brand colour or logo. When
+	// the brand is previewed errors are reported. A brand which can't be used
+	// should not leave the page without a theme, so on page loads we fall back
+	// to the style of the user
+	var preview = r.URL.Query().Has("preview")
+	if brand := r.URL.Query().Get("brand"); brand != "" {
+		color, err := parseBrandColor(brand)
+		if err == nil {
+			return brandTheme(color), nil
+		} else if preview {
+			return t, err
+		}
+		log.Debug("Invalid brand colour '%s': %s", brand, err)
+	} else if path := r.URL.Query().Get("brand_image"); path != "" {
+		colors, err := wc.brandImageColors(path, r.URL.Query().Get("sig"))
+		if err == nil {
+			return brandTheme(colors...), nil
+		} else if preview {
+			return t, err
+		}
+		log.Warn("Brand image '%s' can't be used for theme: %s", path, err)
+	}
+
 	// Get the chosen style from the URL
 	var style = r.URL.Query().Get("style")
 	var hue = -1
@@ -37,74 +91,51 @@ func userStyleFromRequest(r *http.Request) (s template.CSS) {
 		}
 	}
 
-	return userStyle(style, hue)
-}
-
-func userStyle(style string, hue int) template.CSS {
-	var (
-		def      styleSheet
-		light    styleSheet
-		hasLight bool
-	)
-
-	switch style {
-	default:
-		fallthrough
-	case "nord":
-		def = nordDarkStyle
-		light = nordLightStyle
-		hasLight = true
-	case "nord_dark":
-		def = nordDarkStyle
-	case "nord_light", "snowstorm":
-		def = nordLightStyle
-	case "solarized":
-		def = solarizedDarkStyle
-		light = solarizedLightStyle
-		hasLight = true
-	case "solarized_dark":
-		def = solarizedDarkStyle
-	case "solarized_light":
-		def = solarizedLightStyle
-	case "classic":
-		def = classicStyle
-		hue = -1 // Does not support custom hues
-	case "purple_drain":
-		def = purpleDrainStyle
-		hue = -1 // Does not support custom hues
-	case "maroon":
-		def = maroonStyle
-	case "hacker":
-		def = hackerStyle
-		hue = -1 // Does not support custom hues
-	case "canta":
-		def = cantaPixeldrainStyle
-	case "skeuos":
-		def = skeuosPixeldrainStyle
-	case "sweet":
-		def = sweetPixeldrainStyle
-	case "adwaita":
-		def = adwaitaDarkStyle
-		light = adwaitaLightStyle
-		hasLight = true
-	case "adwaita_dark":
-		def = adwaitaDarkStyle
-	case "adwaita_light":
-		def = adwaitaLightStyle
-	case "pixeldrain98":
-		def = pixeldrain98Style
-	}
-
-	if hue >= 0 && hue <= 360 {
-		def = def.withHue(hue)
-		light = light.withHue(hue)
+	if style == "custom" {
+		// A theme in the URL is being previewed, errors are reported. A broken
+		// theme in the cookie should not break the whole website, so we fall
+		// back to the default theme
+		if encoded := r.URL.Query().Get("theme"); encoded != "" {
+			if t, err = themes.customTheme(encoded); err != nil {
+				return t, err
+			}
+		} else if cookie, err := r.Cookie("custom_theme"); err == nil {
+			if t, err = themes.customTheme(cookie.Value); err != nil {
+				log.Debug("Invalid custom theme in cookie: %s", err)
+			}
+		}
+		style = ""
 	}
-
-	if hasLight {
-		return template.CSS(def.withLight(light))
-	} else {
-		return template.CSS(def.String())
+	if t.name == "" {
+		t = themes.resolve(style, hue)
 	}
+	return t, nil
+}
+
+// builtinThemes are the themes which are always available, in the order they
+// are shown on the appearance page. Theme files in the resource directory are
+// added after these, see loadThemes
+var builtinThemes = []theme{
+	{themeInfo{Name: "nord", Title: "Nord", Description: "Inspired by Nord", URL: "https://www.nordtheme.com/", Dark: "nord_dark", Light: "nord_light", Hue: true}, styleSheet{}},
+	{themeInfo{Name: "nord_dark", Title: "Nord dark", Hue: true}, nordDarkStyle},
+	{themeInfo{Name: "nord_light", Title: "Nord light", Hue: true}, nordLightStyle},
+	{themeInfo{Name: "solarized", Title: "Solarized", Description: "Inspired by Solarized", URL: "https://ethanschoonover.com/solarized/", Dark: "solarized_dark", Light: "solarized_light", Hue: true}, styleSheet{}},
+	{themeInfo{Name: "solarized_dark", Title: "Solarized dark", Hue: true}, solarizedDarkStyle},
+	{themeInfo{Name: "solarized_light", Title: "Solarized light", Hue: true}, solarizedLightStyle},
+	{themeInfo{Name: "high_contrast", Title: "High contrast", Description: "Black and white with bold colours, for low vision", Dark: "high_contrast_dark", Light: "high_contrast_light"}, styleSheet{}},
+	{themeInfo{Name: "high_contrast_dark", Title: "High contrast dark"}, highContrastDarkStyle},
+	{themeInfo{Name: "high_contrast_light", Title: "High contrast light"}, highContrastLightStyle},
+	{themeInfo{Name: "purple_drain", Title: "Purple drain", Description: "Classic 2022 style, with purple gradients"}, purpleDrainStyle},
+	{themeInfo{Name: "classic", Title: "Pixeldrain classic (gray)", Description: "Classic pre-2020 pixeldrain style, dark gray"}, classicStyle},
+	{themeInfo{Name: "maroon", Title: "Maroon Style", Description: "Experimental", Hue: true}, maroonStyle},
+	{themeInfo{Name: "hacker", Title: "Hacker Style", Description: "Experimental"}, hackerStyle},
+	{themeInfo{Name: "canta", Title: "Canta Style", Description: "Inspired by Canta GTK", URL: "https://github.com/vinceliuice/Canta-theme", Hue: true}, cantaPixeldrainStyle},
+	{themeInfo{Name: "skeuos", Title: "Skeuos Style", Description: "Inspired by Skeuos GTK", URL: "https://www.gnome-look.org/p/1441725/", Hue: true}, skeuosPixeldrainStyle},
+	{themeInfo{Name: "sweet", Title: "Sweet", Description: "Experimental", Hue: true}, sweetPixeldrainStyle},
+	{themeInfo{Name: "adwaita", Title: "Adwaita", Dark: "adwaita_dark", Light: "adwaita_light", Hue: true}, styleSheet{}},
+	{themeInfo{Name: "adwaita_dark", Title: "Adwaita dark", Hue: true}, adwaitaDarkStyle},
+	{themeInfo{Name: "adwaita_light", Title: "Adwaita light", Hue: true}, adwaitaLightStyle},
+	{themeInfo{Name: "pixeldrain98", Title: "Pixeldrain 98", Hue: true}, pixeldrain98Style},
 }
 
 type styleSheet struct {
@@ -117,6 +148,7 @@ type styleSheet struct {
 	Highlight           HSL // Links, highlighted buttons, list navigation
 	HighlightText       HSL // Text on buttons
 	Danger              HSL
+	DangerText          HSL // Based on HighlightText if undefined
 	ScrollbarForeground CSS // Based on Input if undefined
 	ScrollbarHover      CSS // Based on ScrollbarForeground if undefined
 
@@ -160,6 +192,7 @@ func (s styleSheet) withDefaults() styleSheet {
 	defaultHSL(&s.Chart2, s.Chart1.Add(120, 0, 0))
 	defaultHSL(&s.Chart3, s.Chart2.Add(120, 0, 0))
 	defaultCSS(&s.HighlightBackground, s.Highlight)
+	defaultHSL(&s.DangerText, s.HighlightText)
 	defaultCSS(&s.Background, s.BackgroundColor)
 	defaultCSS(&s.BackgroundPattern, s.BackgroundColor)
 	defaultCSS(&s.Navigation, RawCSS("none"))
@@ -173,10 +206,11 @@ func (s styleSheet) withDefaults() styleSheet {
 func (s styleSheet) withHue(hue int) styleSheet {
 	s = s.withDefaults()
 
+	// The hue is changed in OKLCH, so the colours look as light as they did
+	// in the original theme
 	var setHue = func(c CSS) CSS {
 		if hsl, ok := c.(HSL); ok {
-			hsl.Hue = hue
-			return hsl
+			return hsl.withHuePerceptual(hue)
 		} else {
 			return c
 		}
@@ -188,89 +222,124 @@ func (s styleSheet) withHue(hue int) styleSheet {
 	s.InputDisabledText = setHue(s.InputDisabledText)
 	s.ScrollbarForeground = setHue(s.ScrollbarForeground)
 	s.ScrollbarHover = setHue(s.ScrollbarHover)
-	s.BackgroundColor.Hue = hue
+	s.BackgroundColor = s.BackgroundColor.withHuePerceptual(hue)
 	s.Background = setHue(s.Background)
-	s.BackgroundText.Hue = hue
+	s.BackgroundText = s.BackgroundText.withHuePerceptual(hue)
 	s.BackgroundPattern = setHue(s.BackgroundPattern)
 	s.Navigation = setHue(s.Navigation)
-	s.BodyColor.Hue = hue
+	s.BodyColor = s.BodyColor.withHuePerceptual(hue)
 	s.BodyBackground = setHue(s.BodyBackground)
-	s.BodyText.Hue = hue
-	s.Separator.Hue = hue
-	s.CardColor.Hue = hue
-	s.CardText.Hue = hue
+	s.BodyText = s.BodyText.withHuePerceptual(hue)
+	s.Separator = s.Separator.withHuePerceptual(hue)
+	s.CardColor = s.CardColor.withHuePerceptual(hue)
+	s.CardText = s.CardText.withHuePerceptual(hue)
 	return s
 }
 
 func (s styleSheet) String() string {
+	return s.rules() + s.printRules() + accessibilityRules
+}
+
+// styleVariable is a CSS variable of a theme
+type styleVariable struct {
+	Name  string
+	Value CSS
+}
+
+// variables returns the CSS variables of the theme in groups. The variables
+// are used for theme.css and for the theme exports, so they always match
+func (s styleSheet) variables() [][]styleVariable {
 	s = s.withDefaults()
 
+	return [][]styleVariable{
+		{
+			{"link_color", s.Link},
+			{"input_background", s.Input},
+			{"input_hover_background", s.InputHover},
+			{"input_text", s.InputText},
+			{"input_disabled_text", s.InputDisabledText},
+			{"highlight_background", s.HighlightBackground},
+			{"highlight_color", s.Highlight},
+			{"highlight_text_color", s.HighlightText},
+			{"danger_color", s.Danger},
+			{"danger_text_color", s.DangerText},
+			{"scrollbar_foreground_color", s.ScrollbarForeground},
+			{"scrollbar_hover_color", s.ScrollbarHover},
+		}, {
+			{"background_color", s.BackgroundColor},
+			{"background", s.Background},
+			{"background_text_color", s.BackgroundText},
+			{"background_pattern_color", s.BackgroundPattern},
+			{"navigation_background", s.Navigation},
+			{"body_color", s.BodyColor},
+			{"body_background", s.BodyBackground},
+			{"body_text_color", s.BodyText},
+			{"separator", s.Separator},
+			{"shaded_background", s.BodyColor.WithAlpha(0.75)},
+			{"card_color", s.CardColor},
+		}, {
+			{"chart_1_color", s.Chart1},
+			{"chart_2_color", s.Chart2},
+			{"chart_3_color", s.Chart3},
+		}, {
+			{"shadow_color", s.BodyColor.Darken(0.8)},
+		},
+	}
+}
+
+// rules returns the variables and style overrides of the theme, followed by
+// the text colours to use when the user asks for more contrast
+func (s styleSheet) rules() string {
+	return s.rootRules() + "\n" + s.StyleOverrides + "\n" + s.moreContrastRules()
+}
+
+// rootRules returns the variables of the theme
+func (s styleSheet) rootRules() string {
+	var b strings.Builder
+	b.WriteString(":root {\n")
+	for i, group := range s.variables() {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+
+		// The values in a group are aligned
+		var width = 0
+		for _, v := range group {
+			width = max(width, len(v.Name)+1)
+		}
+		for _, v := range group {
+			fmt.Fprintf(&b, "\t--%-*s %s;\n", width, v.Name+":", v.Value.CSS())
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// moreContrastRules raises the contrast of all text to WCAG AAA when the
+// operating system asks for more contrast. Decorations are removed
+func (s styleSheet) moreContrastRules() string {
+	s = s.withContrast(contrastAAA)
+
 	return fmt.Sprintf(
-		`:root {
-	--link_color:                 %s;
-	--input_background:           %s;
-	--input_hover_background:     %s;
-	--input_text:                 %s;
-	--input_disabled_text:        %s;
-	--highlight_background:       %s;
-	--highlight_color:            %s;
-	--highlight_text_color:       %s;
-	--danger_color:               %s;
-	--danger_text_color:          %s;
-	--scrollbar_foreground_color: %s;
-	--scrollbar_hover_color:      %s;
-
-	--background_color:         %s;
-	--background:               %s;
-	--background_text_color:    %s;
-	--background_pattern:       url("%s");
-	--background_pattern_color: %s;
-	--navigation_background:    %s;
-	--body_color:               %s;
-	--body_background:          %s;
-	--body_text_color:          %s;
-	--separator:                %s;
-	--shaded_background:        %s;
-	--card_color:               %s;
-
-	--chart_1_color: %s;
-	--chart_2_color: %s;
-	--chart_3_color: %s;
-
-	--shadow_color: %s;
-}
-
-%s
+		`
+@media (prefers-contrast: more) {
+	:root {
+		--link_color:            %s;
+		--input_text:            %s;
+		--highlight_text_color:  %s;
+		--danger_text_color:     %s;
+		--background_text_color: %s;
+		--body_text_color:       %s;
+		--background_pattern:    none;
+	}
+}
 `,
 		s.Link.CSS(),
-		s.Input.CSS(),
-		s.InputHover.CSS(),
 		s.InputText.CSS(),
-		s.InputDisabledText.CSS(),
-		s.HighlightBackground.CSS(),
-		s.Highlight.CSS(),
 		s.HighlightText.CSS(),
-		s.Danger.CSS(),
-		s.HighlightText.CSS(),
-		s.ScrollbarForeground.CSS(),
-		s.ScrollbarHover.CSS(),
-		s.BackgroundColor.CSS(),
-		s.Background.CSS(),
+		s.DangerText.CSS(),
 		s.BackgroundText.CSS(),
-		BackgroundTiles(),
-		s.BackgroundPattern.CSS(),
-		s.Navigation.CSS(),
-		s.BodyColor.CSS(),
-		s.BodyBackground.CSS(),
 		s.BodyText.CSS(),
-		s.Separator.CSS(),
-		s.BodyColor.WithAlpha(0.75).CSS(), // shaded_background
-		s.CardColor.CSS(),
-		s.Chart1.CSS(),
-		s.Chart2.CSS(),
-		s.Chart3.CSS(),
-		s.BodyColor.Darken(0.8).CSS(),
-		s.StyleOverrides,
 	)
 }
 
@@ -280,36 +349,157 @@ func (dark styleSheet) withLight(light styleSheet) string {
 
 @media (prefers-color-scheme: light) {
 	%s
-}`,
-		dark.String(),
-		light.String(),
+}
+%s%s`,
+		dark.rules(),
+		light.rules(),
+		light.printRules(),
+		accessibilityRules,
 	)
 }
 
-func BackgroundTiles() template.URL {
-	var (
-		now   = time.Now()
-		month = now.Month()
-		day   = now.Day()
-		file  string
-	)
+// printStyle returns the palette which is used for printing. Printers need dark
+// text on a white background, only the highlight, danger and chart colours of
+// the theme are kept. Text colours are corrected to WCAG AAA, light colours
+// fade on paper
+func (s styleSheet) printStyle() styleSheet {
+	s = s.withDefaults()
+	var white, black = HSL{0, 0, 1}, HSL{0, 0, .05}
+
+	return styleSheet{
+		Link:              s.Link,
+		Input:             HSL{0, 0, .94},
+		InputHover:        HSL{0, 0, .9},
+		InputText:         black,
+		InputDisabledText: HSL{0, 0, .4},
+		Highlight:         s.Highlight,
+		HighlightText:     s.HighlightText,
+		Danger:            s.Danger,
+		DangerText:        s.DangerText,
+
+		BackgroundColor: white,
+		BackgroundText:  black,
+		BodyColor:       white,
+		BodyText:        black,
+		Separator:       HSL{0, 0, .8},
+		CardColor:       HSL{0, 0, .96},
+
+		Chart1: s.Chart1,
+		Chart2: s.Chart2,
+		Chart3: s.Chart3,
+	}.withContrast(contrastAAA)
+}
+
+// printSheet returns the style sheet for printing: the print palette of the
+// theme and printLayoutRules
+func (s styleSheet) printSheet() string {
+	return s.printStyle().rootRules() + printLayoutRules
+}
+
+// printRules returns the print style sheet in a print media query, it's added
+// to every theme
+func (s styleSheet) printRules() string {
+	var b strings.Builder
+	b.WriteString("\n@media print {\n")
+	for _, line := range strings.Split(strings.TrimSpace(s.printSheet()), "\n") {
+		if line != "" {
+			b.WriteString("\t")
+		}
+		b.WriteString(line + "\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// printLayoutRules hide the navigation and decorations when printing. Links
+// show their address, because they can't be clicked on paper
+const printLayoutRules = `
+:root {
+	--background_pattern: none;
+}
+body {
+	background: none;
+	font-size: 12pt;
+	transition: none;
+}
+.page_navigation,
+.button_toggle_navigation,
+.breadcrumbs,
+.print_link,
+footer {
+	display: none !important;
+}
+.page_body {
+	margin: 0 !important;
+	overflow: visible !important;
+}
+.page_content {
+	margin: 0 !important;
+	box-shadow: none !important;
+}
+a[href^="http"]::after,
+a[href^="/"]::after {
+	content: " (" attr(href) ")";
+	font-size: 0.85em;
+	word-break: break-all;
+}
+h1, h2, h3, h4 {
+	break-after: avoid;
+}
+pre, table, img, figure {
+	break-inside: avoid;
+}
+`
 
-	if now.Weekday() == time.Wednesday && rand.Intn(20) == 0 {
-		file = "checker_wednesday"
-	} else if month == time.August && day == 8 {
-		file = "checker_dwarf"
-	} else if month == time.August && day == 24 {
-		file = "checker_developers"
-	} else if month == time.October && day == 31 {
-		file = "checker_halloween"
-	} else if month == time.December && (day == 25 || day == 26 || day == 27) {
-		file = "checker_christmas"
-	} else {
-		file = fmt.Sprintf("checker%d", now.UnixNano()%20)
+// accessibilityRules are added to every theme. When the user prefers reduced
+// motion animations and the background pattern are turned off. In forced
+// colours mode the browser chooses the colours, then our gradients and
+// patterns are replaced by system colours
+const accessibilityRules = `
+@media (prefers-reduced-motion: reduce) {
+	:root {
+		--background_pattern: none;
+	}
+	*, *::before, *::after {
+		animation-duration: 0.01ms !important;
+		animation-iteration-count: 1 !important;
+		transition-duration: 0.01ms !important;
+		scroll-behavior: auto !important;
 	}
+}
 
-	return template.URL("/res/img/background_patterns/" + file + "_transparent.png")
+@media (forced-colors: active) {
+	:root {
+		--link_color:             LinkText;
+		--input_background:       ButtonFace;
+		--input_hover_background: ButtonFace;
+		--input_text:             ButtonText;
+		--input_disabled_text:    GrayText;
+		--highlight_background:   Highlight;
+		--highlight_color:        Highlight;
+		--highlight_text_color:   HighlightText;
+		--danger_color:           Mark;
+		--danger_text_color:      MarkText;
+		--background:             Canvas;
+		--background_color:       Canvas;
+		--background_text_color:  CanvasText;
+		--background_pattern:     none;
+		--navigation_background:  Canvas;
+		--body_color:             Canvas;
+		--body_background:        Canvas;
+		--body_text_color:        CanvasText;
+		--separator:              CanvasText;
+	}
 }
+`
+
+// noPatternRules turns off the background pattern, for users who disabled it
+// on the appearance page. See servePatternCSS
+const noPatternRules = `
+:root {
+	--background_pattern: none;
+}
+`
 
 // Following are all the available styles
 
@@ -322,6 +512,7 @@ var purpleDrainStyle = styleSheet{
 	Highlight:           HSL{117, .63, .46},
 	HighlightText:       HSL{0, 0, 0},
 	Danger:              HSL{357, .63, .46},
+	DangerText:          HSL{0, 0, .9},
 	ScrollbarForeground: HSL{266, .85, .40},
 	ScrollbarHover:      HSL{266, .85, .50},
 
@@ -343,6 +534,7 @@ var classicStyle = styleSheet{
 	Highlight:         HSL{89, .60, .45},
 	HighlightText:     HSL{0, 0, 0},
 	Danger:            HSL{339, .65, .31},
+	DangerText:        HSL{0, 0, .9},
 
 	BackgroundColor: HSL{0, 0, .08},
 	BodyColor:       HSL{0, 0, .12},
@@ -358,6 +550,7 @@ var maroonStyle = styleSheet{
 	Highlight:         HSL{137, 1, .37}, //hsl(137, 100%, 37%)
 	HighlightText:     HSL{0, 0, 0},
 	Danger:            HSL{9, .96, .42}, //hsl(9, 96%, 42%)
+	DangerText:        HSL{0, 0, 1},
 
 	BackgroundColor: HSL{0, .7, .05},
 	BodyColor:       HSL{0, .8, .08}, // HSL{0, .8, .15},
@@ -373,6 +566,7 @@ var hackerStyle = styleSheet{
 	Highlight:         HSL{120, .8, .5},
 	HighlightText:     HSL{0, 0, 0},
 	Danger:            HSL{0, 1, .4},
+	DangerText:        HSL{0, 0, .9},
 
 	BackgroundColor: HSL{0, 0, 0},
 	BodyColor:       HSL{0, 0, .03},
@@ -381,6 +575,7 @@ var hackerStyle = styleSheet{
 }
 
 var cantaPixeldrainStyle = styleSheet{
+	Link:              HSL{165, 1, .36},
 	Input:             HSL{167, .06, .30}, // hsl(167, 6%, 30%)
 	InputHover:        HSL{167, .06, .35}, // hsl(167, 6%, 30%)
 	InputText:         HSL{0, 0, 1},
@@ -396,6 +591,7 @@ var cantaPixeldrainStyle = styleSheet{
 }
 
 var skeuosPixeldrainStyle = styleSheet{
+	Link:              HSL{282, .65, .65},
 	Input:             HSL{226, .15, .23}, //hsl(226, 15%, 23%)
 	InputHover:        HSL{226, .15, .28},
 	InputText:         HSL{60, .06, .93},
@@ -425,6 +621,7 @@ var (
 )
 
 var nordDarkStyle = styleSheet{
+	Link:                nord14.Add(0, 0, -.04),
 	Input:               nord3.Add(0, 0, 0.01),
 	InputHover:          nord3.Add(0, 0, 0.03),
 	InputText:           nord5,
@@ -432,6 +629,7 @@ var nordDarkStyle = styleSheet{
 	Highlight:           nord14,
 	HighlightText:       nord0,
 	Danger:              nord11,
+	DangerText:          HSL{220, .16, .07},
 	ScrollbarForeground: nord7,
 	ScrollbarHover:      nord8,
 
@@ -450,6 +648,7 @@ var nordLightStyle = styleSheet{
 	Highlight:           nord14,
 	HighlightText:       nord1,
 	Danger:              nord11,
+	DangerText:          HSL{220, .16, .07},
 	ScrollbarForeground: nord7,
 	ScrollbarHover:      nord8,
 
@@ -463,13 +662,15 @@ var nordLightStyle = styleSheet{
 }
 
 var sweetPixeldrainStyle = styleSheet{
+	Link:              HSL{296, .88, .50},
 	Input:             HSL{229, .25, .18}, // hsl(229, 25%, 14%)
 	InputHover:        HSL{229, .25, .23}, // hsl(229, 25%, 14%)
 	InputText:         HSL{223, .13, .79},
 	InputDisabledText: HSL{0, 0, .5},
 	Highlight:         HSL{296, .88, .44},
-	HighlightText:     HSL{0, 0, 0},
+	HighlightText:     HSL{0, 0, 1},
 	Danger:            HSL{356, 1, .64}, // hsl(356, 100%, 64%)
+	DangerText:        HSL{0, 0, .15},
 
 	BackgroundColor: HSL{225, .25, .06}, // hsl(225, 25%, 6%)
 	BodyColor:       HSL{228, .25, .12}, // hsl(228, 25%, 12%)
@@ -478,6 +679,7 @@ var sweetPixeldrainStyle = styleSheet{
 }
 
 var adwaitaDarkStyle = styleSheet{
+	Link:              HSL{152, .62, .38},
 	Input:             RGBA{255, 255, 255, .06},
 	InputHover:        RGBA{255, 255, 255, .11},
 	InputText:         HSL{0, 0, 1},
@@ -493,13 +695,15 @@ var adwaitaDarkStyle = styleSheet{
 }
 
 var adwaitaLightStyle = styleSheet{
+	Link:              HSL{152, .62, .31},
 	Input:             RGBA{0, 0, 0, .06},
 	InputHover:        RGBA{0, 0, 0, .11},
 	InputText:         HSL{0, 0, .2},
 	InputDisabledText: HSL{0, 0, .7},
 	Highlight:         HSL{152, .62, .47}, // hsl(152, 62%, 47%)
-	HighlightText:     HSL{0, 0, 1},
+	HighlightText:     HSL{0, 0, .2},
 	Danger:            HSL{356, .75, .43}, // hsl(356, 75%, 43%)
+	DangerText:        HSL{0, 0, 1},
 
 	BackgroundColor: HSL{0, 0, .92},
 	BodyColor:       HSL{0, 0, .98},
@@ -509,13 +713,15 @@ var adwaitaLightStyle = styleSheet{
 }
 
 var solarizedDarkStyle = styleSheet{
+	Link:              HSL{68, 1, .32},
 	Input:             HSL{192, .81, .18}, // hsl(194, 14%, 40%)
 	InputHover:        HSL{192, .81, .23}, // hsl(196, 13%, 45%)
 	InputText:         HSL{180, .07, .80}, // hsl(44, 87%, 94%)
 	InputDisabledText: HSL{194, .14, .30}, // hsl(194, 14%, 40%)
 	Highlight:         HSL{68, 1, .30},    // hsl(68, 100%, 30%)
-	HighlightText:     HSL{192, .81, .14}, // hsl(192, 100%, 11%)
+	HighlightText:     HSL{192, .81, .12}, // hsl(192, 100%, 11%)
 	Danger:            HSL{1, .71, .52},   // hsl(1, 71%, 52%)
+	DangerText:        HSL{44, .87, .97},
 
 	BackgroundColor: HSL{192, 1, .11},   //hsl(192, 100%, 11%)
 	BodyColor:       HSL{192, .81, .14}, // hsl(192, 81%, 14%)
@@ -524,13 +730,15 @@ var solarizedDarkStyle = styleSheet{
 }
 
 var solarizedLightStyle = styleSheet{
+	Link:              HSL{68, 1, .23},
 	Input:             HSL{46, .42, .84},
 	InputHover:        HSL{46, .42, .80},
 	InputText:         HSL{194, .14, .20}, // hsl(192, 81%, 14%)
 	InputDisabledText: HSL{44, .87, .94},
 	Highlight:         HSL{68, 1, .30}, // hsl(68, 100%, 30%)
-	HighlightText:     HSL{44, .87, .94},
+	HighlightText:     HSL{192, .81, .12},
 	Danger:            HSL{1, .71, .52}, // hsl(1, 71%, 52%)
+	DangerText:        HSL{44, .87, .97},
 
 	BackgroundColor: HSL{46, .42, .88}, // hsl(46, 42%, 88%)
 	BackgroundText:  HSL{192, .81, .14},
@@ -540,6 +748,63 @@ var solarizedLightStyle = styleSheet{
 	CardColor:       HSL{44, .87, .92},
 }
 
+// overrideHighContrast underlines links and makes the keyboard focus easier
+// to find
+const overrideHighContrast = `
+:root {
+	--background_pattern: none;
+}
+a {
+	text-decoration: underline !important;
+}
+:focus-visible {
+	outline: 3px solid var(--highlight_color) !important;
+	outline-offset: 2px;
+}
+`
+
+var highContrastDarkStyle = styleSheet{
+	Link:              HSL{60, 1, .6},
+	Input:             HSL{0, 0, .15},
+	InputHover:        HSL{0, 0, .25},
+	InputText:         HSL{0, 0, 1},
+	InputDisabledText: HSL{0, 0, .6},
+	Highlight:         HSL{60, 1, .5},
+	HighlightText:     HSL{0, 0, 0},
+	Danger:            HSL{0, 1, .75},
+	Navigation:        RawCSS("none"),
+
+	BackgroundColor: HSL{0, 0, 0},
+	BackgroundText:  HSL{0, 0, 1},
+	BodyColor:       HSL{0, 0, .04},
+	BodyText:        HSL{0, 0, 1},
+	Separator:       HSL{0, 0, 1},
+	CardColor:       HSL{0, 0, .1},
+
+	StyleOverrides: overrideHighContrast,
+}
+
+var highContrastLightStyle = styleSheet{
+	Link:              HSL{240, 1, .35},
+	Input:             HSL{0, 0, .9},
+	InputHover:        HSL{0, 0, .82},
+	InputText:         HSL{0, 0, 0},
+	InputDisabledText: HSL{0, 0, .4},
+	Highlight:         HSL{240, 1, .3},
+	HighlightText:     HSL{0, 0, 1},
+	Danger:            HSL{0, 1, .35},
+	Navigation:        RawCSS("none"),
+
+	BackgroundColor: HSL{0, 0, 1},
+	BackgroundText:  HSL{0, 0, 0},
+	BodyColor:       HSL{0, 0, 1},
+	BodyText:        HSL{0, 0, 0},
+	Separator:       HSL{0, 0, .1},
+	CardColor:       HSL{0, 0, .95},
+
+	StyleOverrides: overrideHighContrast,
+}
+
 const override98 = `
 button, .button,
 dialog,
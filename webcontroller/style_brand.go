@@ -0,0 +1,389 @@
+package webcontroller
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // Supported logo formats
+	_ "image/jpeg" // Supported logo formats
+	_ "image/png"  // Supported logo formats
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fornaxian.tech/log"
+)
+
+// Branded directories, files and lists can have a theme which is generated
+// from a single brand colour, or from the dominant colours of a logo. The
+// theme has a dark and a light variant which are chosen by the colour scheme
+// the OS prefers, like the built-in dynamic themes
+
+// brandPalette generates a dark and a light style sheet from brand colours.
+// The first colour is used for highlights and tints the backgrounds, the other
+// colours are used for charts. When less than three colours are given, the
+// chart colours are picked at equal distances on the colour wheel. Text
+// colours are corrected to reach WCAG AA
+func brandPalette(colors ...Color) (dark, light styleSheet) {
+	var base = colors[0].HSL()
+	var hue, sat = base.Hue, clamp(base.Saturation, .35, .9)
+
+	// Danger is red, unless the brand is red. Then it's moved towards orange
+	// so it stands out from the highlight colour
+	var dangerHue = 355
+	if hue < 25 || hue > 335 {
+		dangerHue = 25
+	}
+
+	var charts = []HSL{base, base.Add(120, 0, 0), base.Add(240, 0, 0)}
+	for i, c := range colors[1:] {
+		if i+1 < len(charts) {
+			charts[i+1] = c.HSL()
+		}
+	}
+
+	var tint = func(s, l float64) HSL { return HSL{hue, sat * s, l} }
+
+	dark = styleSheet{
+		Input:             tint(.3, .22),
+		InputHover:        tint(.3, .26),
+		InputText:         tint(.1, .92),
+		InputDisabledText: tint(.1, .45),
+		Highlight:         HSL{hue, sat, clamp(base.Lightness, .45, .65)},
+		HighlightText:     bestText(HSL{hue, sat, clamp(base.Lightness, .45, .65)}),
+		Danger:            HSL{dangerHue, .75, .6},
+		DangerText:        HSL{0, 0, .05},
+
+		BackgroundColor: tint(.25, .08),
+		BodyColor:       tint(.25, .12),
+		BodyText:        tint(.1, .88),
+		CardColor:       tint(.25, .16),
+
+		Chart1: charts[0],
+		Chart2: charts[1],
+		Chart3: charts[2],
+	}
+	light = styleSheet{
+		Input:             tint(.25, .86),
+		InputHover:        tint(.25, .82),
+		InputText:         tint(.2, .15),
+		InputDisabledText: tint(.1, .65),
+		Highlight:         HSL{hue, sat, clamp(base.Lightness, .35, .5)},
+		HighlightText:     bestText(HSL{hue, sat, clamp(base.Lightness, .35, .5)}),
+		Danger:            HSL{dangerHue, .75, .45},
+		DangerText:        HSL{0, 0, 1},
+
+		BackgroundColor: tint(.3, .9),
+		BackgroundText:  tint(.2, .15),
+		BodyColor:       tint(.3, .97),
+		BodyText:        tint(.2, .2),
+		Separator:       tint(.3, .88),
+		CardColor:       tint(.3, .93),
+
+		Chart1: charts[0],
+		Chart2: charts[1],
+		Chart3: charts[2],
+	}
+	return dark.withContrast(contrastAA), light.withContrast(contrastAA)
+}
+
+func clamp(v, min, max float64) float64 { return math.Max(min, math.Min(max, v)) }
+
+// bestText returns black or white, whichever has more contrast with the
+// background
+func bestText(bg Color) HSL {
+	var black, white = HSL{0, 0, .05}, HSL{0, 0, 1}
+	if contrastRatio(black, bg) > contrastRatio(white, bg) {
+		return black
+	}
+	return white
+}
+
+// parseBrandColor parses the brand parameter. The # of hex colours is optional,
+// because it has to be escaped in URLs
+func parseBrandColor(str string) (Color, error) {
+	if hexColorRegexp.MatchString("#" + str) {
+		str = "#" + str
+	}
+	c, err := parseColor(str)
+	if err != nil {
+		return nil, fmt.Errorf("invalid brand colour: %w", err)
+	}
+	return c, nil
+}
+
+// brandTheme returns the theme for brand colours
+func brandTheme(colors ...Color) resolvedTheme {
+	var dark, light = brandPalette(colors...)
+	var key = "brand"
+	for _, c := range colors {
+		key += ":" + c.CSS()
+	}
+	return resolvedTheme{name: "brand", title: "Brand theme", style: dark, light: &light, key: key}
+}
+
+// dominantColors returns the most common colours in an image, most common
+// first. Transparent pixels are skipped, and colours which are almost gray
+// count less because logos are usually on a white or black background
+func dominantColors(img image.Image, n int) (colors []Color) {
+	type bucket struct {
+		r, g, b float64 // Sums, for the average colour
+		weight  float64
+	}
+	var buckets = make(map[uint16]*bucket)
+
+	// Large images are sampled, about 128x128 pixels is enough
+	var bounds = img.Bounds()
+	var step = max(1, max(bounds.Dx(), bounds.Dy())/128)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r32, g32, b32, a32 := img.At(x, y).RGBA()
+			if a32 < 0x8000 {
+				continue
+			}
+			// Undo the alpha premultiplication
+			var r, g, b = uint8(r32 * 0xff / a32), uint8(g32 * 0xff / a32), uint8(b32 * 0xff / a32)
+			var hsl = RGB{r, g, b}.HSL()
+
+			// 4 bits per channel
+			var key = uint16(r>>4)<<8 | uint16(g>>4)<<4 | uint16(b>>4)
+			var bk = buckets[key]
+			if bk == nil {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			var weight = 0.1 + hsl.Saturation*(1-math.Abs(hsl.Lightness*2-1))
+			bk.r += float64(r) * weight
+			bk.g += float64(g) * weight
+			bk.b += float64(b) * weight
+			bk.weight += weight
+		}
+	}
+
+	var sorted = make([]*bucket, 0, len(buckets))
+	for _, bk := range buckets {
+		sorted = append(sorted, bk)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].weight > sorted[j].weight })
+
+	for _, bk := range sorted {
+		var c = RGB{
+			uint8(math.Round(bk.r / bk.weight)),
+			uint8(math.Round(bk.g / bk.weight)),
+			uint8(math.Round(bk.b / bk.weight)),
+		}
+
+		// Neighbouring buckets often contain the same colour, those are
+		// skipped so the chart colours are different
+		var similar = false
+		for _, prev := range colors {
+			if hueDistance(prev.HSL().Hue, c.HSL().Hue) < 30 {
+				similar = true
+			}
+		}
+		if !similar {
+			colors = append(colors, c)
+		}
+		if len(colors) == n {
+			break
+		}
+	}
+	return colors
+}
+
+func hueDistance(a, b int) int {
+	var d = (a - b + 360) % 360
+	return min(d, 360-d)
+}
+
+// Logos are downloaded from the filesystem API. The colours are kept for a
+// while so the logo does not have to be downloaded for every page view, and
+// failed downloads are remembered for a few minutes. The size of the image is
+// checked before it's decoded, so a small file can't decompress into a huge
+// image. We only sample about 128x128 pixels, so logos don't need to be large.
+// Only a few logos are downloaded at the same time, when more are requested
+// the brand theme is not used
+const (
+	brandImageMaxSize      = 2 << 20
+	brandImageMaxPixels    = 1024 * 1024
+	brandImageMaxDownloads = 4
+	brandImageCacheTTL     = time.Hour
+	brandImageErrorTTL     = 5 * time.Minute
+	brandImageCacheSize    = 1000
+)
+
+// Filesystem paths and file IDs which can be used as logo
+var brandImageRegexp = regexp.MustCompile(`^[^.][^?#\\]*$`)
+
+// brandImageColors is a cache entry, with the colours of the logo or the error
+// which occurred when it was downloaded
+type brandImageColors struct {
+	colors  []Color
+	err     error
+	fetched time.Time
+}
+
+func (img brandImageColors) expired() bool {
+	if img.err != nil {
+		return time.Since(img.fetched) > brandImageErrorTTL
+	}
+	return time.Since(img.fetched) > brandImageCacheTTL
+}
+
+// brandImageCall is a download of a logo which is in progress. Requests for
+// the same logo wait for it instead of downloading the logo again
+type brandImageCall struct {
+	done   chan struct{}
+	colors []Color
+	err    error
+}
+
+// brandImageCache holds the dominant colours of logos, keyed by filesystem
+// path. Old entries are removed when new colours are stored, and when the
+// cache is full the oldest entry makes room
+type brandImageCache struct {
+	mu        sync.Mutex
+	images    map[string]brandImageColors
+	calls     map[string]*brandImageCall
+	downloads int // Number of calls in progress
+}
+
+var errBrandImageBusy = errors.New("too many brand images are being downloaded, try again later")
+
+// do returns the colours of a logo from the cache. If they're not cached the
+// colours are fetched, only once for all concurrent requests of the same path.
+// When too many logos are being fetched an error is returned, that error is
+// not cached
+func (c *brandImageCache) do(path string, fetch func() ([]Color, error)) ([]Color, error) {
+	c.mu.Lock()
+	if img, ok := c.images[path]; ok && !img.expired() {
+		c.mu.Unlock()
+		return img.colors, img.err
+	}
+	if call, ok := c.calls[path]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.colors, call.err
+	}
+	if c.downloads >= brandImageMaxDownloads {
+		c.mu.Unlock()
+		return nil, errBrandImageBusy
+	}
+	if c.calls == nil {
+		c.calls = make(map[string]*brandImageCall)
+	}
+	var call = &brandImageCall{done: make(chan struct{})}
+	c.calls[path] = call
+	c.downloads++
+	c.mu.Unlock()
+
+	call.colors, call.err = fetch()
+
+	c.mu.Lock()
+	c.put(path, brandImageColors{colors: call.colors, err: call.err, fetched: time.Now()})
+	delete(c.calls, path)
+	c.downloads--
+	c.mu.Unlock()
+	close(call.done)
+	return call.colors, call.err
+}
+
+// put stores colours in the cache, the lock must be held
+func (c *brandImageCache) put(path string, img brandImageColors) {
+	if c.images == nil {
+		c.images = make(map[string]brandImageColors)
+	}
+	var oldest string
+	for key, img := range c.images {
+		if img.expired() {
+			delete(c.images, key)
+		} else if oldest == "" || img.fetched.Before(c.images[oldest].fetched) {
+			oldest = key
+		}
+	}
+	if len(c.images) >= brandImageCacheSize {
+		delete(c.images, oldest)
+	}
+	c.images[path] = img
+}
+
+// brandImageSignature signs the path of a logo. Theme URLs of branded
+// directories contain the signature, so theme.css only downloads logos which
+// are configured in the branding of a directory
+func (wc *WebController) brandImageSignature(path string) string {
+	var key = wc.brandImageKey
+	if conf := wc.config().BrandImageKey; conf != "" {
+		key = []byte(conf)
+	}
+	var mac = hmac.New(sha256.New, key)
+	mac.Write([]byte(path))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// brandImageColors downloads a logo from the filesystem and returns its
+// dominant colours. Only public files can be used, the request is made without
+// the credentials of the user
+func (wc *WebController) brandImageColors(path, signature string) ([]Color, error) {
+	if !hmac.Equal([]byte(signature), []byte(wc.brandImageSignature(path))) {
+		return nil, errors.New("invalid brand image signature")
+	}
+	if strings.Contains(path, "..") || !brandImageRegexp.MatchString(path) {
+		return nil, errors.New("invalid brand image path")
+	}
+	return wc.brandImages.do(path, func() ([]Color, error) {
+		return wc.fetchBrandImageColors(path)
+	})
+}
+
+func (wc *WebController) fetchBrandImageColors(path string) ([]Color, error) {
+	var segments = strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	resp, err := wc.httpClient.Get(wc.config().APIURLInternal + "/filesystem/" + strings.Join(segments, "/"))
+	if err != nil {
+		// The error contains the internal API address, it's not shown to the user
+		log.Warn("Failed to download brand image '%s': %s", path, err)
+		return nil, errors.New("failed to download brand image")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download brand image: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, brandImageMaxSize))
+	if err != nil {
+		return nil, errors.New("failed to download brand image")
+	}
+
+	// Only the header is read to get the size of the image, the pixels are
+	// decoded when the size is acceptable
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("brand image can't be read, use PNG, JPEG or GIF: %w", err)
+	}
+	if conf.Width <= 0 || conf.Height <= 0 || conf.Width*conf.Height > brandImageMaxPixels {
+		return nil, fmt.Errorf("brand image of %dx%d pixels is too large", conf.Width, conf.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("brand image can't be read, use PNG, JPEG or GIF: %w", err)
+	}
+	var colors = dominantColors(img, 3)
+	if len(colors) == 0 {
+		return nil, errors.New("brand image has no visible pixels")
+	}
+	return colors, nil
+}
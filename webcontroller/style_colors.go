@@ -3,6 +3,9 @@ package webcontroller
 import (
 	"fmt"
 	"math"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 type Color interface {
@@ -137,7 +140,7 @@ var _ Color = RGB{}
 
 func (rgb RGB) CSS() string { return fmt.Sprintf("#%02x%02x%02x", rgb.R, rgb.G, rgb.B) }
 func (rgb RGB) HSL() HSL {
-	var r, g, b = float64(rgb.R), float64(rgb.G), float64(rgb.B)
+	var r, g, b = float64(rgb.R) / 255, float64(rgb.G) / 255, float64(rgb.B) / 255
 	var h, s, l float64
 
 	max := math.Max(math.Max(r, g), b)
@@ -179,7 +182,7 @@ func (rgb RGB) HSL() HSL {
 		h -= 1
 	}
 
-	return HSL{int(h), s, l}
+	return HSL{int(math.Round(h*360)) % 360, s, l}
 }
 func (rgb RGB) RGB() RGB { return rgb }
 
@@ -210,14 +213,95 @@ func NewGradient(angle int, colors ...Color) Gradient {
 	return Gradient{angle, colors}
 }
 
+// CSS renders the gradient. Colours are interpolated in OKLab, see oklabStops
 func (g Gradient) CSS() string {
-	var colors string
-	for i, color := range g.Colors {
-		if i != 0 {
-			colors += ", "
+	return fmt.Sprintf("linear-gradient(%ddeg, %s)", g.Angle, strings.Join(g.oklabStops(), ", "))
+}
+
+var (
+	hexColorRegexp  = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+	funcColorRegexp = regexp.MustCompile(`^(rgba?|hsla?)\(\s*([0-9.]+)\s*,\s*([0-9.]+%?)\s*,\s*([0-9.]+%?)\s*(?:,\s*([0-9.]+)\s*)?\)$`)
+)
+
+// parseColor parses a CSS colour in hex, rgb(), rgba(), hsl() or hsla()
+// notation. Values are range checked, so the result can safely be put in a
+// style sheet
+func parseColor(str string) (Color, error) {
+	str = strings.ToLower(strings.TrimSpace(str))
+
+	if m := hexColorRegexp.FindStringSubmatch(str); m != nil {
+		var hex = m[1]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		var v, _ = strconv.ParseUint(hex, 16, 32)
+		if len(hex) == 8 {
+			return RGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), float64(uint8(v)) / 255}, nil
+		}
+		return RGB{uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+	}
+
+	var m = funcColorRegexp.FindStringSubmatch(str)
+	if m == nil {
+		return nil, fmt.Errorf("'%s' is not a colour, use #rrggbb, rgb(), rgba(), hsl() or hsla()", str)
+	}
+
+	// Parses a number and checks if it's within bounds. Percentages are
+	// converted to fractions
+	var num = func(s string, max float64) (float64, error) {
+		var pct = strings.HasSuffix(s, "%")
+		f, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number '%s' in colour '%s'", s, str)
+		}
+		if pct {
+			f, max = f/100, 1
+		}
+		if f < 0 || f > max {
+			return 0, fmt.Errorf("number '%s' is out of range in colour '%s'", s, str)
 		}
-		colors += color.CSS()
+		return f, nil
 	}
 
-	return fmt.Sprintf("linear-gradient(%ddeg, %s)", g.Angle, colors)
+	var alpha = 1.0
+	if m[5] != "" {
+		var err error
+		if alpha, err = num(m[5], 1); err != nil {
+			return nil, err
+		}
+	}
+
+	if strings.HasPrefix(m[1], "rgb") {
+		var c [3]float64
+		for i := range c {
+			var err error
+			if c[i], err = num(m[i+2], 255); err != nil {
+				return nil, err
+			}
+			if strings.HasSuffix(m[i+2], "%") {
+				c[i] *= 255
+			}
+		}
+		if m[5] != "" {
+			return RGBA{uint8(c[0]), uint8(c[1]), uint8(c[2]), alpha}, nil
+		}
+		return RGB{uint8(c[0]), uint8(c[1]), uint8(c[2])}, nil
+	}
+
+	hue, err := num(m[2], 360)
+	if err != nil {
+		return nil, err
+	}
+	sat, err := num(m[3], 1)
+	if err != nil {
+		return nil, err
+	}
+	light, err := num(m[4], 1)
+	if err != nil {
+		return nil, err
+	}
+	if m[5] != "" {
+		return HSLA{int(hue), sat, light, alpha}, nil
+	}
+	return HSL{int(hue), sat, light}, nil
 }
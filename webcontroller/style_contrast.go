@@ -0,0 +1,240 @@
+package webcontroller
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Minimum contrast ratios from the Web Content Accessibility Guidelines, see
+// https://www.w3.org/TR/WCAG21/#contrast-minimum
+const (
+	contrastAA  = 4.5
+	contrastAAA = 7.0
+)
+
+// Luminance returns the relative luminance of the colour, from 0 for black to 1
+// for white
+func (rgb RGB) Luminance() float64 {
+	return 0.2126*gammaDecode(rgb.R) + 0.7152*gammaDecode(rgb.G) + 0.0722*gammaDecode(rgb.B)
+}
+
+// contrastRatio returns the contrast ratio between two colours, from 1 for
+// identical colours to 21 for black on white
+func contrastRatio(a, b Color) float64 {
+	var la, lb = a.RGB().Luminance(), b.RGB().Luminance()
+	if la < lb {
+		la, lb = lb, la
+	}
+	return (la + 0.05) / (lb + 0.05)
+}
+
+// minContrast returns the lowest contrast ratio of the foreground against any
+// of the backgrounds
+func minContrast(fg Color, bgs []Color) float64 {
+	var min = 21.0
+	for _, bg := range bgs {
+		min = math.Min(min, contrastRatio(fg, bg))
+	}
+	return min
+}
+
+// colorsOf returns the colours in a style value. Gradients consist of multiple
+// colours, raw CSS has no colours we know of. Translucent colours are blended
+// with the colour below them
+func colorsOf(below Color, values ...CSS) (colors []Color) {
+	var add = func(c Color) {
+		switch c := c.(type) {
+		case RGBA:
+			colors = append(colors, blend(c.RGB(), below.RGB(), c.A))
+		case HSLA:
+			colors = append(colors, blend(c.RGB(), below.RGB(), c.Alpha))
+		default:
+			colors = append(colors, c)
+		}
+	}
+	for _, v := range values {
+		switch v := v.(type) {
+		case Color:
+			add(v)
+		case Gradient:
+			for _, c := range v.Colors {
+				add(c)
+			}
+		}
+	}
+	return colors
+}
+
+// blend returns the colour of a translucent colour on top of another colour
+func blend(top, below RGB, alpha float64) RGB {
+	var mix = func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a)*alpha + float64(b)*(1-alpha)))
+	}
+	return RGB{mix(top.R, below.R), mix(top.G, below.G), mix(top.B, below.B)}
+}
+
+// nudgeContrast changes the lightness of a text colour until it has at least
+// the given contrast with all the backgrounds. The lightness moves away from
+// the backgrounds first, if that's not enough the other direction is tried.
+// The hue and saturation are kept
+func nudgeContrast(fg HSL, bgs []Color, min float64) HSL {
+	if len(bgs) == 0 || minContrast(fg, bgs) >= min {
+		return fg
+	}
+
+	// Light text on dark backgrounds and dark text on light backgrounds. Below
+	// this luminance white text has more contrast than black text
+	var lighten = false
+	for _, bg := range bgs {
+		if bg.RGB().Luminance() < 0.179 {
+			lighten = true
+		}
+	}
+
+	var best, bestRatio = fg, minContrast(fg, bgs)
+	for _, step := range []float64{.01, -.01} {
+		if !lighten {
+			step = -step
+		}
+		for i := 1; i <= 100; i++ {
+			var c = fg
+			c.Lightness = math.Round((fg.Lightness+step*float64(i))*100) / 100
+			if c.Lightness < 0 || c.Lightness > 1 {
+				break
+			}
+			if ratio := minContrast(c, bgs); ratio >= min {
+				return c
+			} else if ratio > bestRatio {
+				best, bestRatio = c, ratio
+			}
+		}
+	}
+	return best
+}
+
+// contrastPair is a text colour in a style sheet and the backgrounds it's
+// shown on
+type contrastPair struct {
+	name string
+	fg   CSS
+	bgs  []Color
+	set  func(s *styleSheet, c HSL) // Replaces the text colour
+}
+
+// contrastPairs returns the text and background combinations of the style
+// sheet. Disabled inputs are left out, they don't need to be readable
+func (s styleSheet) contrastPairs() []contrastPair {
+	s = s.withDefaults()
+	return []contrastPair{
+		{
+			"body_text on body_color", s.BodyText, colorsOf(s.BackgroundColor, s.BodyColor, s.BodyBackground),
+			func(s *styleSheet, c HSL) { s.BodyText = c },
+		}, {
+			"link on body_color", s.Link, colorsOf(s.BackgroundColor, s.BodyColor, s.BodyBackground),
+			func(s *styleSheet, c HSL) { s.Link = c },
+		}, {
+			"background_text on background_color", s.BackgroundText, colorsOf(s.BackgroundColor, s.BackgroundColor, s.Background),
+			func(s *styleSheet, c HSL) { s.BackgroundText = c },
+		}, {
+			"highlight_text on highlight", s.HighlightText, colorsOf(s.BodyColor, s.Highlight, s.HighlightBackground),
+			func(s *styleSheet, c HSL) { s.HighlightText = c },
+		}, {
+			"danger_text on danger", s.DangerText, colorsOf(s.BodyColor, s.Danger),
+			func(s *styleSheet, c HSL) { s.DangerText = c },
+		}, {
+			"input_text on input", s.InputText, colorsOf(s.BodyColor, s.Input, s.InputHover),
+			func(s *styleSheet, c HSL) { s.InputText = c },
+		},
+	}
+}
+
+// contrastIssue is a text colour which does not have enough contrast with its
+// background
+type contrastIssue struct {
+	Pair  string
+	Ratio float64
+	Fix   Color // Closest colour with enough contrast
+}
+
+func (i contrastIssue) String() string {
+	return fmt.Sprintf("%s has a contrast ratio of %.2f, %s would fix it", i.Pair, i.Ratio, i.Fix.CSS())
+}
+
+// checkContrast returns the text colours in the style sheet which have less
+// than the minimum contrast ratio
+func (s styleSheet) checkContrast(min float64) (issues []contrastIssue) {
+	for _, pair := range s.contrastPairs() {
+		fg, ok := pair.fg.(Color)
+		if !ok || len(pair.bgs) == 0 {
+			continue
+		}
+		if ratio := minContrast(fg, pair.bgs); ratio < min {
+			issues = append(issues, contrastIssue{
+				Pair:  pair.name,
+				Ratio: ratio,
+				Fix:   nudgeContrast(fg.HSL(), pair.bgs, min),
+			})
+		}
+	}
+	return issues
+}
+
+// withContrast nudges the lightness of the text colours which don't have the
+// minimum contrast ratio with their backgrounds. Only colours which the theme
+// defined as plain colours are changed
+func (s styleSheet) withContrast(min float64) styleSheet {
+	s = s.withDefaults()
+	for _, pair := range s.contrastPairs() {
+		fg, ok := pair.fg.(Color)
+		if !ok || minContrast(fg, pair.bgs) >= min {
+			continue
+		}
+		pair.set(&s, nudgeContrast(fg.HSL(), pair.bgs, min))
+	}
+	return s
+}
+
+// LintThemes checks the contrast of all themes in the resource directory. The
+// colours of every theme must pass WCAG AA. Themes which support custom hues
+// are also checked at every 30 degrees of hue, these issues are warnings
+// because they are corrected when the theme is rendered. The report is written
+// to w, an error is returned if a theme fails
+func LintThemes(w io.Writer, resourceDir string) error {
+	reg, err := loadThemes(resourceDir)
+	if err != nil {
+		return err
+	}
+
+	var names = make([]string, 0, len(reg.themes))
+	for name, t := range reg.themes {
+		if !t.dynamic() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var failed []string
+	for _, name := range names {
+		var t = reg.themes[name]
+		for _, issue := range t.style.checkContrast(contrastAA) {
+			fmt.Fprintf(w, "FAIL %s: %s\n", name, issue)
+			failed = append(failed, name)
+		}
+
+		if !t.Hue {
+			continue
+		}
+		for hue := 0; hue < 360; hue += 30 {
+			for _, issue := range t.style.withHue(hue).checkContrast(contrastAA) {
+				fmt.Fprintf(w, "WARN %s at hue %d: %s\n", name, hue, issue)
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d contrast issues in themes which don't meet WCAG AA", len(failed))
+	}
+	return nil
+}
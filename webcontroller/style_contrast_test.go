@@ -0,0 +1,36 @@
+package webcontroller
+
+import (
+	"math"
+	"testing"
+)
+
+func TestContrastRatio(t *testing.T) {
+	for _, test := range []struct {
+		a, b  Color
+		ratio float64
+	}{
+		{RGB{0, 0, 0}, RGB{255, 255, 255}, 21},
+		{RGB{255, 255, 255}, RGB{0, 0, 0}, 21},
+		{RGB{255, 255, 255}, RGB{255, 255, 255}, 1},
+		{RGB{0x77, 0x77, 0x77}, RGB{255, 255, 255}, 4.48},
+		{RGB{255, 0, 0}, RGB{255, 255, 255}, 4.00},
+		{RGB{0, 0, 255}, RGB{0, 0, 0}, 2.44},
+	} {
+		if ratio := contrastRatio(test.a, test.b); math.Abs(ratio-test.ratio) > 0.01 {
+			t.Errorf("contrast of %s on %s is %.3f, expected %.2f", test.a.CSS(), test.b.CSS(), ratio, test.ratio)
+		}
+	}
+}
+
+// All built-in themes must pass WCAG AA without corrections
+func TestBuiltinThemesContrast(t *testing.T) {
+	for _, theme := range builtinThemes {
+		if theme.dynamic() {
+			continue
+		}
+		for _, issue := range theme.style.checkContrast(contrastAA) {
+			t.Errorf("theme %s: %s", theme.Name, issue)
+		}
+	}
+}
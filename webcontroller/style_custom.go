@@ -0,0 +1,328 @@
+package webcontroller
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aymerick/douceur/css"
+	"github.com/aymerick/douceur/parser"
+)
+
+// Users can write their own themes on the appearance page. A theme is a JSON
+// or TOML document with the same fields as the styleSheet struct. Fields which
+// are left out are taken from the base theme. The document is stored in the
+// custom_theme cookie, base64 encoded. It can also be passed to theme.css in
+// the theme parameter for previews
+
+// maxCustomThemeSize is the maximum size of an encoded theme. Cookies can't be
+// much larger than 4 kB
+const maxCustomThemeSize = 3072
+
+// themeColor is a colour in a theme definition, in any notation parseColor
+// understands
+type themeColor struct{ color Color }
+
+func (c *themeColor) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return errors.New("colours must be strings")
+	}
+	return c.UnmarshalText([]byte(str))
+}
+
+func (c *themeColor) UnmarshalText(b []byte) (err error) {
+	c.color, err = parseColor(string(b))
+	return err
+}
+
+// themeValue is a colour, a gradient or the keyword none in a theme
+// definition. Gradients are objects with an angle and a list of colours
+type themeValue struct{ css CSS }
+
+func (v *themeValue) UnmarshalJSON(b []byte) error {
+	var val any
+	if err := json.Unmarshal(b, &val); err != nil {
+		return err
+	}
+	return v.UnmarshalTOML(val)
+}
+
+func (v *themeValue) UnmarshalTOML(val any) error {
+	switch val := val.(type) {
+	case string:
+		if strings.TrimSpace(val) == "none" {
+			v.css = RawCSS("none")
+			return nil
+		}
+		color, err := parseColor(val)
+		v.css = color
+		return err
+	case map[string]any:
+		var g Gradient
+		switch angle := val["angle"].(type) {
+		case float64:
+			g.Angle = int(angle)
+		case int64:
+			g.Angle = int(angle)
+		case nil:
+		default:
+			return errors.New("gradient angle must be a number")
+		}
+		if g.Angle < 0 || g.Angle > 360 {
+			return fmt.Errorf("gradient angle %d is out of range", g.Angle)
+		}
+
+		colors, ok := val["colors"].([]any)
+		if !ok || len(colors) < 2 || len(colors) > 8 {
+			return errors.New("gradients need a list of 2 to 8 colours")
+		}
+		for _, c := range colors {
+			str, ok := c.(string)
+			if !ok {
+				return errors.New("colours must be strings")
+			}
+			color, err := parseColor(str)
+			if err != nil {
+				return err
+			}
+			g.Colors = append(g.Colors, color)
+		}
+		v.css = g
+		return nil
+	default:
+		return errors.New("expected a colour, a gradient or none")
+	}
+}
+
+// themeDefinition is a theme written by a user
+type themeDefinition struct {
+	// Name of the built-in theme this theme is based on
+	Base string `json:"base" toml:"base"`
+
+	Link                themeColor `json:"link" toml:"link"`
+	Input               themeValue `json:"input" toml:"input"`
+	InputHover          themeValue `json:"input_hover" toml:"input_hover"`
+	InputText           themeValue `json:"input_text" toml:"input_text"`
+	InputDisabledText   themeValue `json:"input_disabled_text" toml:"input_disabled_text"`
+	HighlightBackground themeValue `json:"highlight_background" toml:"highlight_background"`
+	Highlight           themeColor `json:"highlight" toml:"highlight"`
+	HighlightText       themeColor `json:"highlight_text" toml:"highlight_text"`
+	Danger              themeColor `json:"danger" toml:"danger"`
+	DangerText          themeColor `json:"danger_text" toml:"danger_text"`
+	ScrollbarForeground themeValue `json:"scrollbar_foreground" toml:"scrollbar_foreground"`
+	ScrollbarHover      themeValue `json:"scrollbar_hover" toml:"scrollbar_hover"`
+
+	BackgroundColor   themeColor `json:"background_color" toml:"background_color"`
+	Background        themeValue `json:"background" toml:"background"`
+	BackgroundText    themeColor `json:"background_text" toml:"background_text"`
+	BackgroundPattern themeValue `json:"background_pattern" toml:"background_pattern"`
+	Navigation        themeValue `json:"navigation" toml:"navigation"`
+	BodyColor         themeColor `json:"body_color" toml:"body_color"`
+	BodyBackground    themeValue `json:"body_background" toml:"body_background"`
+	BodyText          themeColor `json:"body_text" toml:"body_text"`
+	Separator         themeColor `json:"separator" toml:"separator"`
+	CardColor         themeColor `json:"card_color" toml:"card_color"`
+	CardText          themeColor `json:"card_text" toml:"card_text"`
+
+	Chart1 themeColor `json:"chart_1" toml:"chart_1"`
+	Chart2 themeColor `json:"chart_2" toml:"chart_2"`
+	Chart3 themeColor `json:"chart_3" toml:"chart_3"`
+
+	// Extra style rules. Only a safe subset of CSS is allowed, see
+	// sanitizeThemeCSS
+	CSS string `json:"css" toml:"css"`
+}
+
+// decodeThemeSource decodes a theme in JSON or TOML format into v. JSON
+// documents start with a {. Unknown fields are errors, so typos don't go
+// unnoticed
+func decodeThemeSource(src []byte, v any) (err error) {
+	if bytes.HasPrefix(bytes.TrimSpace(src), []byte("{")) {
+		var dec = json.NewDecoder(bytes.NewReader(src))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(v)
+	} else {
+		var md toml.MetaData
+		if md, err = toml.Decode(string(src), v); err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown field '%s'", md.Undecoded()[0])
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid theme: %w", err)
+	}
+	return nil
+}
+
+// styleSheet applies the theme to its base theme from the registry
+func (def themeDefinition) styleSheet(themes *themeRegistry) (s styleSheet, err error) {
+	if s, err = themes.baseStyle(def.Base); err != nil {
+		return s, err
+	}
+
+	for _, f := range []struct {
+		target *HSL
+		value  themeColor
+	}{
+		{&s.Link, def.Link},
+		{&s.Highlight, def.Highlight},
+		{&s.HighlightText, def.HighlightText},
+		{&s.Danger, def.Danger},
+		{&s.DangerText, def.DangerText},
+		{&s.BackgroundColor, def.BackgroundColor},
+		{&s.BackgroundText, def.BackgroundText},
+		{&s.BodyColor, def.BodyColor},
+		{&s.BodyText, def.BodyText},
+		{&s.Separator, def.Separator},
+		{&s.CardColor, def.CardColor},
+		{&s.CardText, def.CardText},
+		{&s.Chart1, def.Chart1},
+		{&s.Chart2, def.Chart2},
+		{&s.Chart3, def.Chart3},
+	} {
+		if f.value.color != nil {
+			*f.target = f.value.color.HSL()
+		}
+	}
+
+	for _, f := range []struct {
+		target *CSS
+		value  themeValue
+	}{
+		{&s.Input, def.Input},
+		{&s.InputHover, def.InputHover},
+		{&s.InputText, def.InputText},
+		{&s.InputDisabledText, def.InputDisabledText},
+		{&s.HighlightBackground, def.HighlightBackground},
+		{&s.ScrollbarForeground, def.ScrollbarForeground},
+		{&s.ScrollbarHover, def.ScrollbarHover},
+		{&s.Background, def.Background},
+		{&s.BackgroundPattern, def.BackgroundPattern},
+		{&s.Navigation, def.Navigation},
+		{&s.BodyBackground, def.BodyBackground},
+	} {
+		if f.value.css != nil {
+			*f.target = f.value.css
+		}
+	}
+
+	if def.CSS != "" {
+		css, err := sanitizeThemeCSS(def.CSS)
+		if err != nil {
+			return s, err
+		}
+		s.StyleOverrides += "\n" + css
+	}
+	return s, nil
+}
+
+// decodeCustomTheme decodes a theme from the custom_theme cookie or the theme
+// URL parameter
+func decodeCustomTheme(encoded string) (def themeDefinition, err error) {
+	if len(encoded) > maxCustomThemeSize {
+		return def, fmt.Errorf("theme is too large, the limit is %d bytes encoded", maxCustomThemeSize)
+	}
+	src, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return def, fmt.Errorf("theme is not encoded correctly: %w", err)
+	}
+	err = decodeThemeSource(src, &def)
+	return def, err
+}
+
+// customTheme decodes an encoded custom theme
+func (themes *themeRegistry) customTheme(encoded string) (resolvedTheme, error) {
+	def, err := decodeCustomTheme(encoded)
+	if err != nil {
+		return resolvedTheme{}, err
+	}
+	s, err := def.styleSheet(themes)
+	if err != nil {
+		return resolvedTheme{}, err
+	}
+	return resolvedTheme{name: "custom", title: "Custom theme", style: s, key: fmt.Sprintf("custom:%s:%d", encoded, themes.generation)}, nil
+}
+
+// Properties which can be used in the CSS of custom themes. Custom properties
+// (--name) are also allowed, so themes can change the theme variables
+var themeCSSProperties = map[string]bool{
+	"color": true, "opacity": true,
+	"background": true, "background-color": true, "background-image": true,
+	"border": true, "border-color": true, "border-width": true, "border-style": true,
+	"border-top": true, "border-right": true, "border-bottom": true, "border-left": true,
+	"border-radius": true, "outline": true, "outline-color": true,
+	"box-shadow": true, "text-shadow": true,
+	"font-weight": true, "font-style": true, "text-decoration": true, "text-transform": true,
+	"letter-spacing": true,
+}
+
+// Functions which can be used in values. Notably url() and image() are
+// missing, themes can't load anything from other servers
+var themeCSSFunctions = map[string]bool{
+	"rgb": true, "rgba": true, "hsl": true, "hsla": true, "var": true, "calc": true,
+	"linear-gradient": true, "radial-gradient": true, "repeating-linear-gradient": true,
+}
+
+var (
+	themeSelectorRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\-.#\s>+~,:*()\[\]=]+$`)
+	themePropertyRegexp = regexp.MustCompile(`^(--[a-z0-9_]+|[a-z\-]+)$`)
+	themeValueRegexp    = regexp.MustCompile(`^[a-zA-Z0-9#%.,\s()\-+/*_]*$`)
+	themeFunctionRegexp = regexp.MustCompile(`([a-zA-Z\-]*)\(`)
+)
+
+// sanitizeThemeCSS parses the CSS of a custom theme and writes it again with
+// only the allowed selectors, properties and values. At-rules, strings,
+// escapes and URLs are rejected. Because the output is written by us and not
+// copied from the input, comments and parser quirks can't be used to sneak
+// something past the checks
+func sanitizeThemeCSS(src string) (string, error) {
+	sheet, err := parser.Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("invalid CSS: %w", err)
+	}
+
+	var out strings.Builder
+	for _, rule := range sheet.Rules {
+		if rule.Kind != css.QualifiedRule {
+			return "", fmt.Errorf("%s rules are not allowed", rule.Name)
+		}
+
+		for _, sel := range rule.Selectors {
+			if !themeSelectorRegexp.MatchString(sel) {
+				return "", fmt.Errorf("selector '%s' contains characters which are not allowed", sel)
+			}
+		}
+		out.WriteString(strings.Join(rule.Selectors, ", ") + " {\n")
+
+		for _, decl := range rule.Declarations {
+			var prop = strings.ToLower(decl.Property)
+			if !themePropertyRegexp.MatchString(prop) || (!strings.HasPrefix(prop, "--") && !themeCSSProperties[prop]) {
+				return "", fmt.Errorf("property '%s' is not allowed", decl.Property)
+			}
+			if !themeValueRegexp.MatchString(decl.Value) {
+				return "", fmt.Errorf("value '%s' of %s contains characters which are not allowed", decl.Value, prop)
+			}
+			for _, m := range themeFunctionRegexp.FindAllStringSubmatch(decl.Value, -1) {
+				if m[1] != "" && !themeCSSFunctions[strings.ToLower(m[1])] {
+					return "", fmt.Errorf("function '%s()' is not allowed", m[1])
+				}
+			}
+			if strings.Count(decl.Value, "(") != strings.Count(decl.Value, ")") {
+				return "", fmt.Errorf("value '%s' of %s has unbalanced parentheses", decl.Value, prop)
+			}
+
+			out.WriteString("\t" + prop + ": " + decl.Value)
+			if decl.Important {
+				out.WriteString(" !important")
+			}
+			out.WriteString(";\n")
+		}
+		out.WriteString("}\n")
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,334 @@
+package webcontroller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"fornaxian.tech/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Themes can be exported to other formats, so other apps can use the same
+// colours as the website. The exports are generated from the variables of the
+// style sheet, the same variables theme.css is made of. Variables which are
+// not colours or gradients, like the background pattern, are left out
+
+// themeExporter writes a theme in an export format
+type themeExporter struct {
+	contentType string
+	extension   string
+	write       func(w io.Writer, t resolvedTheme) error
+}
+
+var themeExporters = map[string]themeExporter{
+	"json":      {"application/json", "tokens.json", exportJSONTokens},
+	"scss":      {"text/x-scss; charset=utf-8", "scss", exportSCSS},
+	"tailwind":  {"text/javascript; charset=utf-8", "tailwind.js", exportTailwind},
+	"alacritty": {"application/toml", "alacritty.toml", exportAlacritty},
+	"svg":       {"image/svg+xml", "svg", exportSwatches},
+}
+
+func themeExportFormats() string {
+	var formats = make([]string, 0, len(themeExporters))
+	for format := range themeExporters {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return strings.Join(formats, ", ")
+}
+
+// exportVariables returns the variables of a style sheet which can be
+// exported, those are colours and gradients
+func exportVariables(s styleSheet) (vars []styleVariable) {
+	for _, group := range s.variables() {
+		for _, v := range group {
+			switch v.Value.(type) {
+			case Color, Gradient:
+				vars = append(vars, v)
+			}
+		}
+	}
+	return vars
+}
+
+// exportName returns the name of a variable in formats which use dashes, with
+// the variant of the theme as prefix
+func exportName(prefix, variant, name string) string {
+	if variant != "" {
+		prefix += "-" + variant
+	}
+	return prefix + "-" + strings.ReplaceAll(name, "_", "-")
+}
+
+// exportJSONTokens writes the theme as design tokens in the format of the
+// Design Tokens Community Group. The variants of dynamic themes are groups
+func exportJSONTokens(w io.Writer, t resolvedTheme) error {
+	type token struct {
+		Type  string `json:"$type"`
+		Value any    `json:"$value"`
+	}
+	type gradientStop struct {
+		Color    string  `json:"color"`
+		Position float64 `json:"position"`
+	}
+
+	var tokens = func(s styleSheet) map[string]any {
+		var group = make(map[string]any)
+		for _, v := range exportVariables(s) {
+			switch val := v.Value.(type) {
+			case Color:
+				group[v.Name] = token{"color", val.CSS()}
+			case Gradient:
+				// The stops include the colours interpolated in OKLab, so
+				// the gradient looks like it does in theme.css
+				var colors = val.oklabStops()
+				var stops = make([]gradientStop, len(colors))
+				for i, c := range colors {
+					stops[i] = gradientStop{c, float64(i) / float64(max(1, len(colors)-1))}
+				}
+				group[v.Name] = token{"gradient", stops}
+			}
+		}
+		return group
+	}
+
+	var doc = map[string]any{"$description": "Pixeldrain theme " + t.title}
+	for _, variant := range t.variants() {
+		if variant.name == "" {
+			for name, tok := range tokens(variant.style) {
+				doc[name] = tok
+			}
+		} else {
+			doc[variant.name] = tokens(variant.style)
+		}
+	}
+
+	var enc = json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(doc)
+}
+
+// exportSCSS writes the theme as SCSS variables
+func exportSCSS(w io.Writer, t resolvedTheme) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Pixeldrain theme %s\n", t.title)
+	for _, variant := range t.variants() {
+		b.WriteString("\n")
+		for _, v := range exportVariables(variant.style) {
+			fmt.Fprintf(&b, "$%s: %s;\n", exportName("pd", variant.name, v.Name), v.Value.CSS())
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// exportTailwind writes the theme as a Tailwind CSS config. Colours are added
+// to the colour palette, gradients to the background images
+func exportTailwind(w io.Writer, t resolvedTheme) error {
+	var b bytes.Buffer
+	var colors, images bytes.Buffer
+	for _, variant := range t.variants() {
+		var group = "pd"
+		if variant.name != "" {
+			group += "-" + variant.name
+		}
+		fmt.Fprintf(&colors, "\t\t\t\t%q: {\n", group)
+		for _, v := range exportVariables(variant.style) {
+			switch v.Value.(type) {
+			case Color:
+				fmt.Fprintf(&colors, "\t\t\t\t\t%q: %q,\n", strings.ReplaceAll(v.Name, "_", "-"), v.Value.CSS())
+			case Gradient:
+				// The CSS of a gradient has the OKLab stops of theme.css
+				fmt.Fprintf(&images, "\t\t\t\t%q: %q,\n", exportName("pd", variant.name, v.Name), v.Value.CSS())
+			}
+		}
+		colors.WriteString("\t\t\t\t},\n")
+	}
+
+	fmt.Fprintf(&b, "// Pixeldrain theme %s\n", t.title)
+	b.WriteString("module.exports = {\n\ttheme: {\n\t\textend: {\n")
+	b.WriteString("\t\t\tcolors: {\n")
+	b.Write(colors.Bytes())
+	b.WriteString("\t\t\t},\n")
+	b.WriteString("\t\t\tbackgroundImage: {\n")
+	b.Write(images.Bytes())
+	b.WriteString("\t\t\t},\n")
+	b.WriteString("\t\t},\n\t},\n}\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// ANSI colours are not part of the themes. They are picked at the usual hues
+// with the lightness and chroma of the highlight colour, so they fit in with
+// the theme. The hues are OKLCH hues
+var ansiHues = []struct {
+	name string
+	hue  float64
+}{
+	{"red", 29}, {"green", 142}, {"yellow", 100}, {"blue", 264}, {"magenta", 328}, {"cyan", 195},
+}
+
+// exportAlacritty writes the theme as a colour scheme for the Alacritty
+// terminal. Terminals have one colour scheme, so dynamic themes are exported
+// with their dark variant
+func exportAlacritty(w io.Writer, t resolvedTheme) error {
+	var s = t.style.withDefaults()
+	var bg, fg = s.BodyColor, s.BodyText
+	var hex = func(c Color) string { return c.RGB().CSS() }
+
+	var base = s.Highlight.RGB().OKLCH()
+	base.C = max(base.C, 0.1)
+	var ansi = func(hue float64, lighten float64) string {
+		var c = base.WithHue(hue).Lighten(lighten).HSL()
+		return hex(nudgeContrast(c, []Color{bg}, contrastAA))
+	}
+
+	// Black is the darkest of the background and text colour, white the
+	// lightest. Light themes have dark text, so they are swapped
+	var black, white = bg, fg
+	if bg.RGB().Luminance() > fg.RGB().Luminance() {
+		black, white = fg, bg
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Pixeldrain theme %s\n", t.title)
+	fmt.Fprintf(&b, "\n[colors.primary]\nbackground = %q\nforeground = %q\n", hex(bg), hex(fg))
+	fmt.Fprintf(&b, "\n[colors.cursor]\ntext = %q\ncursor = %q\n", hex(s.HighlightText), hex(s.Highlight))
+	fmt.Fprintf(&b, "\n[colors.selection]\ntext = %q\nbackground = %q\n", hex(s.HighlightText), hex(s.Highlight))
+
+	for _, section := range []struct {
+		name    string
+		lighten float64
+	}{{"normal", 0}, {"bright", .08}} {
+		fmt.Fprintf(&b, "\n[colors.%s]\n", section.name)
+		fmt.Fprintf(&b, "black = %q\n", hex(black.RGB().OKLCH().Lighten(section.lighten*2)))
+		for _, c := range ansiHues {
+			fmt.Fprintf(&b, "%s = %q\n", c.name, ansi(c.hue, section.lighten))
+		}
+		fmt.Fprintf(&b, "white = %q\n", hex(white.RGB().OKLCH().Lighten(section.lighten)))
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// exportSwatches draws the colours of the theme as an SVG image, with a
+// column for every variant
+func exportSwatches(w io.Writer, t resolvedTheme) error {
+	const (
+		columnWidth = 360
+		rowHeight   = 36
+		header      = 48
+	)
+	// Variants can define different variables, the image fits the longest
+	// column
+	var variants = t.variants()
+	var rows = 0
+	for _, variant := range variants {
+		rows = max(rows, len(exportVariables(variant.style.withDefaults())))
+	}
+	var width, height = columnWidth * len(variants), header + rowHeight*rows
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="14">`+"\n", width, height, width, height)
+	fmt.Fprintf(&b, "<title>Pixeldrain theme %s</title>\n", html.EscapeString(t.title))
+
+	for col, variant := range variants {
+		var s = variant.style.withDefaults()
+		var x = col * columnWidth
+		var title = t.title
+		if variant.name != "" {
+			title += " (" + variant.name + ")"
+		}
+
+		// The swatches are drawn on the body colour, so translucent colours
+		// look like they do on the website
+		fmt.Fprintf(&b, `<rect x="%d" y="0" width="%d" height="%d" fill="%s"/>`+"\n", x, columnWidth, height, s.BodyColor.CSS())
+		fmt.Fprintf(&b, `<text x="%d" y="30" font-size="18" fill="%s">%s</text>`+"\n", x+12, s.BodyText.CSS(), html.EscapeString(title))
+
+		for row, v := range exportVariables(s) {
+			var y = header + row*rowHeight
+			var fill, text string
+			switch val := v.Value.(type) {
+			case Color:
+				fill = val.CSS()
+				text = bestText(colorsOf(s.BodyColor, val)[0]).CSS()
+			case Gradient:
+				var id = fmt.Sprintf("g%d_%d", col, row)
+				writeSVGGradient(&b, id, val)
+				fill = "url(#" + id + ")"
+				text = bestText(colorsOf(s.BodyColor, val)[0]).CSS()
+			}
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"/>`+"\n", x+8, y, columnWidth-16, rowHeight-4, html.EscapeString(fill))
+			fmt.Fprintf(&b,
+				`<text x="%d" y="%d" fill="%s">%s <tspan opacity="0.7">%s</tspan></text>`+"\n",
+				x+16, y+22, text, v.Name, html.EscapeString(v.Value.CSS()),
+			)
+		}
+	}
+	b.WriteString("</svg>\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// writeSVGGradient writes a gradient definition which can be used as fill with
+// url(#id). SVG interpolates in sRGB like CSS, so the stops include the colours
+// interpolated in OKLab
+func writeSVGGradient(b *bytes.Buffer, id string, g Gradient) {
+	// CSS gradients point up at 0 degrees, SVG gradients point right
+	fmt.Fprintf(b, `<linearGradient id="%s" gradientTransform="rotate(%d .5 .5)">`, id, g.Angle-90)
+	var stops = g.oklabStops()
+	for i, c := range stops {
+		fmt.Fprintf(b, `<stop offset="%.2f" stop-color="%s"/>`, float64(i)/float64(max(1, len(stops)-1)), html.EscapeString(c))
+	}
+	b.WriteString("</linearGradient>\n")
+}
+
+// serveThemeExport exports the theme which theme.css would return for the
+// same request. The format is in the URL, see themeExporters
+func (wc *WebController) serveThemeExport(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	exporter, ok := themeExporters[p.ByName("format")]
+	if !ok {
+		http.Error(w, "Unknown export format. Available formats: "+themeExportFormats(), http.StatusNotFound)
+		return
+	}
+	t, err := wc.themeFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err = exporter.write(&buf, t); err != nil {
+		log.Error("Failed to export theme %s: %s", t.name, err)
+		http.Error(w, "Failed to export theme", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", exporter.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="pixeldrain_%s.%s"`, t.name, exporter.extension))
+	varyThemeCookies(w, r)
+	writeCached(w, r, buf.Bytes(), false)
+}
+
+// ExportTheme writes a theme from the resource directory in an export format.
+// See themeExporters for the formats
+func ExportTheme(w io.Writer, resourceDir, name, format string) error {
+	exporter, ok := themeExporters[format]
+	if !ok {
+		return fmt.Errorf("unknown export format '%s', available formats: %s", format, themeExportFormats())
+	}
+	reg, err := loadThemes(resourceDir)
+	if err != nil {
+		return err
+	}
+	if _, ok := reg.get(name); !ok {
+		return fmt.Errorf("theme '%s' does not exist", name)
+	}
+	return exporter.write(w, reg.resolve(name, -1))
+}
@@ -0,0 +1,199 @@
+package webcontroller
+
+import "math"
+
+// OKLab is a perceptual colour space, equal steps in it look like equal
+// changes in colour. Unlike HSL, colours with the same lightness in OKLab look
+// equally light, whatever their hue. See https://bottosson.github.io/posts/oklab/
+//
+// Colours are written to style sheets in hex notation, because not all
+// browsers support the oklab() function yet
+type OKLab struct {
+	L float64 // Lightness, 0 to 1
+	A float64 // Green to red, about -0.4 to 0.4
+	B float64 // Blue to yellow, about -0.4 to 0.4
+}
+
+var _ Color = OKLab{}
+
+func (lab OKLab) CSS() string { return lab.RGB().CSS() }
+func (lab OKLab) HSL() HSL    { return lab.RGB().HSL() }
+
+// RGB converts the colour to sRGB. Colours outside of the sRGB gamut are
+// clipped
+func (lab OKLab) RGB() RGB {
+	var r, g, b = lab.linearRGB()
+	return RGB{gammaEncode(r), gammaEncode(g), gammaEncode(b)}
+}
+
+func (lab OKLab) linearRGB() (r, g, b float64) {
+	var l = lab.L + 0.3963377774*lab.A + 0.2158037573*lab.B
+	var m = lab.L - 0.1055613458*lab.A - 0.0638541728*lab.B
+	var s = lab.L - 0.0894841775*lab.A - 1.2914855480*lab.B
+	l, m, s = l*l*l, m*m*m, s*s*s
+
+	return 4.0767416621*l - 3.3077115913*m + 0.2309699292*s,
+		-1.2684380046*l + 2.6097574011*m - 0.3413193965*s,
+		-0.0041960863*l - 0.7034186147*m + 1.7076147010*s
+}
+
+func (lab OKLab) OKLCH() OKLCH {
+	var h = math.Atan2(lab.B, lab.A) * 180 / math.Pi
+	if h < 0 {
+		h += 360
+	}
+	return OKLCH{lab.L, math.Hypot(lab.A, lab.B), h}
+}
+
+// OKLCH is OKLab in polar coordinates, with a chroma and a hue angle instead of
+// the a and b axes
+type OKLCH struct {
+	L float64 // Lightness, 0 to 1
+	C float64 // Chroma, 0 for gray to about 0.37
+	H float64 // Hue in degrees
+}
+
+var _ Color = OKLCH{}
+
+func (lch OKLCH) CSS() string { return lch.RGB().CSS() }
+func (lch OKLCH) HSL() HSL    { return lch.RGB().HSL() }
+
+// RGB converts the colour to sRGB. Colours outside of the sRGB gamut keep their
+// lightness and hue, the chroma is lowered until the colour fits
+func (lch OKLCH) RGB() RGB {
+	if lch.inGamut() {
+		return lch.OKLab().RGB()
+	}
+	var lo, hi = 0.0, lch.C
+	for i := 0; i < 16; i++ {
+		lch.C = (lo + hi) / 2
+		if lch.inGamut() {
+			lo = lch.C
+		} else {
+			hi = lch.C
+		}
+	}
+	lch.C = lo
+	return lch.OKLab().RGB()
+}
+
+func (lch OKLCH) inGamut() bool {
+	const e = 0.0001
+	var r, g, b = lch.OKLab().linearRGB()
+	return r >= -e && r <= 1+e && g >= -e && g <= 1+e && b >= -e && b <= 1+e
+}
+
+func (lch OKLCH) OKLab() OKLab {
+	var h = lch.H * math.Pi / 180
+	return OKLab{lch.L, lch.C * math.Cos(h), lch.C * math.Sin(h)}
+}
+
+// Lighten returns a NEW colour which looks lighter by the given amount. The
+// amount is on the perceptual lightness scale of 0 to 1
+func (lch OKLCH) Lighten(amount float64) OKLCH {
+	lch.L = clamp(lch.L+amount, 0, 1)
+	return lch
+}
+
+// Darken returns a NEW colour which looks darker by the given amount
+func (lch OKLCH) Darken(amount float64) OKLCH { return lch.Lighten(-amount) }
+
+// WithHue returns a NEW colour with a different hue, the perceived lightness
+// and the chroma stay the same
+func (lch OKLCH) WithHue(hue float64) OKLCH {
+	lch.H = math.Mod(hue+360, 360)
+	return lch
+}
+
+// OKLab converts the colour to OKLab
+func (rgb RGB) OKLab() OKLab {
+	var r, g, b = gammaDecode(rgb.R), gammaDecode(rgb.G), gammaDecode(rgb.B)
+
+	var l = math.Cbrt(0.4122214708*r + 0.5363325363*g + 0.0514459929*b)
+	var m = math.Cbrt(0.2119034982*r + 0.6806995451*g + 0.1073969566*b)
+	var s = math.Cbrt(0.0883024619*r + 0.2817188376*g + 0.6299787005*b)
+
+	return OKLab{
+		0.2104542553*l + 0.7936177850*m - 0.0040720468*s,
+		1.9779984951*l - 2.4285922050*m + 0.4505937099*s,
+		0.0259040371*l + 0.7827717662*m - 0.8086757660*s,
+	}
+}
+
+// OKLCH converts the colour to OKLCH
+func (rgb RGB) OKLCH() OKLCH { return rgb.OKLab().OKLCH() }
+
+// gammaDecode converts an sRGB channel to linear light
+func gammaDecode(v uint8) float64 {
+	var c = float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// gammaEncode converts linear light to an sRGB channel, values outside of the
+// gamut are clipped
+func gammaEncode(c float64) uint8 {
+	if c <= 0.0031308 {
+		c *= 12.92
+	} else {
+		c = 1.055*math.Pow(c, 1/2.4) - 0.055
+	}
+	return uint8(math.Round(clamp(c, 0, 1) * 255))
+}
+
+// MixOKLab mixes two colours in OKLab. With t = 0 the result is a, with t = 1
+// it's b. Mixing in OKLab does not produce the muddy middle colours of sRGB
+func MixOKLab(a, b Color, t float64) OKLab {
+	var x, y = a.RGB().OKLab(), b.RGB().OKLab()
+	return OKLab{
+		x.L + (y.L-x.L)*t,
+		x.A + (y.A-x.A)*t,
+		x.B + (y.B-x.B)*t,
+	}
+}
+
+// withHuePerceptual changes the hue of the colour to the given HSL hue while
+// keeping its perceived lightness and chroma. Changing the hue in HSL makes
+// yellows much lighter than blues, this keeps the contrast of the theme intact
+func (hsl HSL) withHuePerceptual(hue int) HSL {
+	if hsl.Saturation == 0 {
+		hsl.Hue = hue
+		return hsl
+	}
+
+	// The hue angles of HSL and OKLCH are different, the target hue is the
+	// OKLCH hue of the colour with its hue changed in HSL
+	var target = HSL{hue, hsl.Saturation, hsl.Lightness}.RGB().OKLCH().H
+	return hsl.RGB().OKLCH().WithHue(target).HSL()
+}
+
+// gradientSteps is the number of colours added between two colours of a
+// gradient. Browsers interpolate in sRGB, the added colours make the gradient
+// follow OKLab instead
+const gradientSteps = 3
+
+// oklabStops returns the colours of the gradient, with interpolated colours
+// added between them. Translucent colours are left alone, OKLab has no alpha
+func (g Gradient) oklabStops() []string {
+	var opaque = func(c Color) bool {
+		switch c.(type) {
+		case RGBA, HSLA:
+			return false
+		}
+		return true
+	}
+
+	var stops []string
+	for i, c := range g.Colors {
+		if i > 0 && opaque(c) && opaque(g.Colors[i-1]) {
+			var prev = g.Colors[i-1]
+			for step := 1; step <= gradientSteps; step++ {
+				stops = append(stops, MixOKLab(prev, c, float64(step)/(gradientSteps+1)).CSS())
+			}
+		}
+		stops = append(stops, c.CSS())
+	}
+	return stops
+}
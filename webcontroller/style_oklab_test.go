@@ -0,0 +1,90 @@
+package webcontroller
+
+import (
+	"math"
+	"testing"
+)
+
+// Reference values from https://bottosson.github.io/posts/oklab/ and CSS Color
+// Module Level 4
+func TestRGBToOKLab(t *testing.T) {
+	for _, test := range []struct {
+		rgb RGB
+		lab OKLab
+	}{
+		{RGB{255, 255, 255}, OKLab{1, 0, 0}},
+		{RGB{0, 0, 0}, OKLab{0, 0, 0}},
+		{RGB{255, 0, 0}, OKLab{0.62796, 0.22486, 0.12585}},
+		{RGB{0, 255, 0}, OKLab{0.86644, -0.23389, 0.17950}},
+		{RGB{0, 0, 255}, OKLab{0.45201, -0.03246, -0.31153}},
+	} {
+		var lab = test.rgb.OKLab()
+		if math.Abs(lab.L-test.lab.L) > 1e-4 || math.Abs(lab.A-test.lab.A) > 1e-4 || math.Abs(lab.B-test.lab.B) > 1e-4 {
+			t.Errorf("%s is %+v in OKLab, expected %+v", test.rgb.CSS(), lab, test.lab)
+		}
+		if rgb := test.lab.RGB(); rgb != test.rgb {
+			t.Errorf("%+v is %s in sRGB, expected %s", test.lab, rgb.CSS(), test.rgb.CSS())
+		}
+	}
+}
+
+func TestOKLabRoundTrip(t *testing.T) {
+	for r := 0; r < 256; r += 15 {
+		for g := 0; g < 256; g += 15 {
+			for b := 0; b < 256; b += 15 {
+				var rgb = RGB{uint8(r), uint8(g), uint8(b)}
+				if out := rgb.OKLab().RGB(); out != rgb {
+					t.Errorf("%s became %s through OKLab", rgb.CSS(), out.CSS())
+				}
+				if out := rgb.OKLCH().RGB(); out != rgb {
+					t.Errorf("%s became %s through OKLCH", rgb.CSS(), out.CSS())
+				}
+			}
+		}
+	}
+}
+
+// Colours outside of sRGB keep their lightness and hue, only the chroma is
+// lowered
+func TestOKLCHGamutMapping(t *testing.T) {
+	for _, lch := range []OKLCH{
+		{0.7, 0.4, 150},
+		{0.5, 0.35, 270},
+		{0.9, 0.3, 30},
+		{0.3, 0.25, 90},
+	} {
+		if lch.inGamut() {
+			t.Fatalf("%+v is in the sRGB gamut, the test needs a colour outside of it", lch)
+		}
+		var out = lch.RGB().OKLCH()
+		if math.Abs(out.L-lch.L) > 0.01 {
+			t.Errorf("%+v mapped to %+v, lightness changed", lch, out)
+		}
+		if d := math.Abs(math.Mod(out.H-lch.H+540, 360) - 180); d > 3 {
+			t.Errorf("%+v mapped to %+v, hue changed by %.1f degrees", lch, out, d)
+		}
+		if out.C >= lch.C {
+			t.Errorf("%+v mapped to %+v, chroma was not lowered", lch, out)
+		}
+	}
+}
+
+// Changing the hue must not change the perceived lightness, so themes keep
+// their contrast at every hue
+func TestWithHuePerceptual(t *testing.T) {
+	for _, hsl := range []HSL{
+		{220, .5, .3},
+		{120, .8, .5},
+		{40, .9, .6},
+		{300, .3, .8},
+		{0, 0, .5},
+	} {
+		var l = hsl.RGB().OKLab().L
+		for hue := 0; hue < 360; hue += 15 {
+			var out = hsl.withHuePerceptual(hue)
+			if d := math.Abs(out.RGB().OKLab().L - l); d > 0.01 {
+				t.Errorf("%+v at hue %d is %+v, lightness changed by %.3f", hsl, hue, out, d)
+			}
+		}
+	}
+}
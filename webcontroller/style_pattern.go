@@ -0,0 +1,263 @@
+package webcontroller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/util"
+	"github.com/BurntSushi/toml"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Pages have a background pattern, which is served in pattern.css so theme.css
+// does not change every day. The pattern of the day is picked from a list with
+// a hash of the date, so everyone sees the same pattern on the same day and
+// pattern.css can be cached until the day changes in UTC. On holidays a special
+// pattern is shown. The patterns and holidays are read from
+// background_patterns.toml in the resource directory.
+//
+// Users can pick a pattern on the appearance page, or turn the pattern off.
+// The choice is stored in the background_pattern cookie
+
+const patternCalendarFile = "background_patterns.toml"
+
+// Pattern names are file names, without the _transparent.png suffix
+var patternNameRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// patternHoliday replaces the pattern of the day on certain days. A holiday is
+// on fixed dates or on a day of the week. Holidays with a chance below 1 only
+// show their pattern on some of those days
+type patternHoliday struct {
+	Name    string   `toml:"name"`
+	Dates   []string `toml:"dates"`   // Month and day, like 12-25
+	Weekday string   `toml:"weekday"` // Name of the day, like Wednesday
+	Chance  float64  `toml:"chance"`
+	Pattern string   `toml:"pattern"`
+}
+
+func (h patternHoliday) on(day time.Time) bool {
+	if h.Weekday != "" && strings.EqualFold(h.Weekday, day.Weekday().String()) {
+		return true
+	}
+	for _, date := range h.Dates {
+		if date == day.Format("01-02") {
+			return true
+		}
+	}
+	return false
+}
+
+// patternCalendar decides which background pattern is shown on a day
+type patternCalendar struct {
+	Patterns []string         `toml:"patterns"`
+	Holidays []patternHoliday `toml:"holiday"`
+}
+
+// defaultPatternCalendar is used when there is no pattern calendar in the
+// resource directory, or when it can't be loaded
+func defaultPatternCalendar() *patternCalendar {
+	var cal = &patternCalendar{}
+	for i := 0; i < 20; i++ {
+		cal.Patterns = append(cal.Patterns, fmt.Sprintf("checker%d", i))
+	}
+	return cal
+}
+
+// loadPatternCalendar reads the pattern calendar from the resource directory.
+// If it can't be loaded the default calendar is returned with the error
+func loadPatternCalendar(resourceDir string) (*patternCalendar, error) {
+	var path = filepath.Join(resourceDir, patternCalendarFile)
+	var cal patternCalendar
+	if _, err := toml.DecodeFile(path, &cal); errors.Is(err, fs.ErrNotExist) {
+		return defaultPatternCalendar(), nil
+	} else if err != nil {
+		return defaultPatternCalendar(), fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cal.check(resourceDir); err != nil {
+		return defaultPatternCalendar(), fmt.Errorf("%s: %w", path, err)
+	}
+	return &cal, nil
+}
+
+// check validates the calendar and confirms that the pattern images exist
+func (cal *patternCalendar) check(resourceDir string) error {
+	if len(cal.Patterns) == 0 {
+		return errors.New("no patterns are listed")
+	}
+
+	for i := range cal.Holidays {
+		var h = &cal.Holidays[i]
+		if len(h.Dates) == 0 && h.Weekday == "" {
+			return fmt.Errorf("holiday '%s' needs dates or a weekday", h.Name)
+		}
+		for _, date := range h.Dates {
+			if _, err := time.Parse("01-02", date); err != nil {
+				return fmt.Errorf("holiday '%s' has invalid date '%s', use month-day like 12-25", h.Name, date)
+			}
+		}
+		if h.Weekday != "" && !isWeekday(h.Weekday) {
+			return fmt.Errorf("holiday '%s' has invalid weekday '%s'", h.Name, h.Weekday)
+		}
+		if h.Chance == 0 {
+			h.Chance = 1
+		} else if h.Chance < 0 || h.Chance > 1 {
+			return fmt.Errorf("holiday '%s' has a chance of %g, it must be between 0 and 1", h.Name, h.Chance)
+		}
+	}
+
+	for _, name := range cal.names() {
+		if !patternNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid pattern name '%s'", name)
+		}
+		if _, err := os.Stat(filepath.Join(resourceDir, "static", patternPath(name))); err != nil {
+			return fmt.Errorf("pattern '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+func isWeekday(name string) bool {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(name, d.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// names returns all patterns in the calendar, including those of holidays
+func (cal *patternCalendar) names() (names []string) {
+	var seen = make(map[string]bool)
+	var add = func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, name := range cal.Patterns {
+		add(name)
+	}
+	for _, h := range cal.Holidays {
+		add(h.Pattern)
+	}
+	return names
+}
+
+func (cal *patternCalendar) has(name string) bool {
+	for _, n := range cal.names() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// patternOfDay returns the pattern for a day. The first holiday on the day
+// which passes its chance wins, otherwise a pattern is picked from the list
+func (cal *patternCalendar) patternOfDay(day time.Time) string {
+	var date = day.Format("2006-01-02")
+	for _, h := range cal.Holidays {
+		if h.on(day) && float64(dayHash(date, h.Name)%10000) < h.Chance*10000 {
+			return h.Pattern
+		}
+	}
+	return cal.Patterns[dayHash(date, "")%uint32(len(cal.Patterns))]
+}
+
+// dayHash is a hash of the date, the salt makes sure that holidays with a
+// chance don't fall on the same days
+func dayHash(date, salt string) uint32 {
+	var h = fnv.New32a()
+	h.Write([]byte(date + "/" + salt))
+	return h.Sum32()
+}
+
+// patternPath returns the path of a pattern image, relative to the static
+// resources
+func patternPath(name string) string {
+	return "/img/background_patterns/" + name + "_transparent.png"
+}
+
+// patternRules returns the style sheet which sets the background pattern
+func patternRules(name string) string {
+	return fmt.Sprintf(":root {\n\t--background_pattern: url(\"/res%s\");\n}\n", patternPath(name))
+}
+
+// loadPatterns loads the pattern calendar from the resource directory. Errors
+// are logged, the default calendar is used then
+func (wc *WebController) loadPatterns() {
+	cal, err := loadPatternCalendar(wc.config().ResourceDir)
+	if err != nil {
+		log.Error("Failed to load background patterns: %s", err)
+	}
+	wc.patterns.Store(cal)
+}
+
+// servePatternCSS serves the background pattern of the user. That's the
+// pattern chosen in the pattern parameter or the background_pattern cookie, or
+// the pattern of the day. This style sheet has to be loaded before theme.css,
+// so themes and accessibility settings can turn the pattern off
+func (wc *WebController) servePatternCSS(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var cal = wc.patterns.Load()
+	var pattern = r.URL.Query().Get("pattern")
+	if pattern == "" {
+		w.Header().Add("Vary", "Cookie")
+		if cookie, err := r.Cookie("background_pattern"); err == nil {
+			pattern = cookie.Value
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/css")
+	if pattern == "off" {
+		writeCached(w, r, []byte(noPatternRules), false)
+		return
+	} else if cal.has(pattern) {
+		writeCached(w, r, []byte(patternRules(pattern)), false)
+		return
+	}
+
+	// The pattern of the day is the same for everyone, it can be cached until
+	// the day changes
+	var now = time.Now().UTC()
+	var midnight = now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(midnight.Sub(now).Seconds())))
+
+	var css = []byte(patternRules(cal.patternOfDay(now)))
+	if checkETag(w, r, etagFor(css)) {
+		return
+	}
+	if _, err := w.Write(css); err != nil && !util.IsNetError(err) {
+		log.Error("Error writing response: %s", err)
+	}
+}
+
+// servePatternsJSON lists the patterns which can be picked on the appearance
+// page
+func (wc *WebController) servePatternsJSON(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type pattern struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	}
+	var list = []pattern{}
+	for _, name := range wc.patterns.Load().names() {
+		list = append(list, pattern{name, "/res" + patternPath(name)})
+	}
+
+	body, err := json.Marshal(list)
+	if err != nil {
+		log.Error("Failed to encode pattern list: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeCached(w, r, body, false)
+}
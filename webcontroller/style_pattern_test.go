@@ -0,0 +1,112 @@
+package webcontroller
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Everyone has to see the same pattern on the same day, no matter the time of
+// day or how often it's asked for
+func TestPatternOfDay(t *testing.T) {
+	var cal = defaultPatternCalendar()
+	var seen = make(map[string]bool)
+	var day = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		var pattern = cal.patternOfDay(day)
+		if !cal.has(pattern) {
+			t.Fatalf("pattern of %s is '%s', which is not in the calendar", day.Format("2006-01-02"), pattern)
+		}
+		for _, other := range []time.Time{day.Add(time.Second), day.Add(12 * time.Hour), day.Add(24*time.Hour - time.Second)} {
+			if p := cal.patternOfDay(other); p != pattern {
+				t.Errorf("pattern of %s is '%s', at %s it's '%s'", day, pattern, other, p)
+			}
+		}
+		seen[pattern] = true
+		day = day.AddDate(0, 0, 1)
+	}
+	if len(seen) < len(cal.Patterns)/2 {
+		t.Errorf("only %d of the %d patterns were picked in 100 days", len(seen), len(cal.Patterns))
+	}
+}
+
+func TestPatternOfDayHolidays(t *testing.T) {
+	var cal = &patternCalendar{
+		Patterns: []string{"plain"},
+		Holidays: []patternHoliday{
+			{Name: "christmas", Dates: []string{"12-25", "12-26"}, Chance: 1, Pattern: "snow"},
+			{Name: "wednesday", Weekday: "wednesday", Chance: 1, Pattern: "frog"},
+			{Name: "never", Dates: []string{"06-01"}, Chance: 0.0001, Pattern: "rare"},
+		},
+	}
+	for _, test := range []struct {
+		date    string
+		pattern string
+	}{
+		{"2024-12-25", "snow"}, // Also a Wednesday, the first holiday wins
+		{"2024-12-26", "snow"},
+		{"2024-12-27", "plain"},
+		{"2024-06-05", "frog"},
+		{"2024-06-01", "plain"},
+	} {
+		day, _ := time.Parse("2006-01-02", test.date)
+		if p := cal.patternOfDay(day); p != test.pattern {
+			t.Errorf("pattern of %s is '%s', expected '%s'", test.date, p, test.pattern)
+		}
+	}
+}
+
+func TestPatternCalendarCheck(t *testing.T) {
+	var dir = t.TempDir()
+	var patternDir = filepath.Join(dir, "static", "img", "background_patterns")
+	if err := os.MkdirAll(patternDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"plain", "snow"} {
+		if err := os.WriteFile(filepath.Join(patternDir, name+"_transparent.png"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var christmas = patternHoliday{Name: "christmas", Dates: []string{"12-25"}, Pattern: "snow"}
+	var holiday = func(edit func(h *patternHoliday)) []patternHoliday {
+		var h = christmas
+		edit(&h)
+		return []patternHoliday{h}
+	}
+
+	for _, test := range []struct {
+		name string
+		cal  patternCalendar
+		err  string // Part of the error, empty if the calendar is valid
+	}{
+		{"valid", patternCalendar{Patterns: []string{"plain"}, Holidays: []patternHoliday{christmas}}, ""},
+		{"weekday", patternCalendar{Patterns: []string{"plain"}, Holidays: holiday(func(h *patternHoliday) { h.Dates, h.Weekday = nil, "Friday" })}, ""},
+		{"no patterns", patternCalendar{}, "no patterns"},
+		{"missing image", patternCalendar{Patterns: []string{"plain", "rain"}}, "pattern 'rain'"},
+		{"invalid name", patternCalendar{Patterns: []string{"../plain"}}, "invalid pattern name"},
+		{"missing holiday image", patternCalendar{Patterns: []string{"plain"}, Holidays: holiday(func(h *patternHoliday) { h.Pattern = "rain" })}, "pattern 'rain'"},
+		{"no dates", patternCalendar{Patterns: []string{"plain"}, Holidays: holiday(func(h *patternHoliday) { h.Dates = nil })}, "needs dates or a weekday"},
+		{"invalid date", patternCalendar{Patterns: []string{"plain"}, Holidays: holiday(func(h *patternHoliday) { h.Dates = []string{"25-12"} })}, "invalid date"},
+		{"invalid weekday", patternCalendar{Patterns: []string{"plain"}, Holidays: holiday(func(h *patternHoliday) { h.Weekday = "Caturday" })}, "invalid weekday"},
+		{"invalid chance", patternCalendar{Patterns: []string{"plain"}, Holidays: holiday(func(h *patternHoliday) { h.Chance = 1.5 })}, "chance"},
+	} {
+		var err = test.cal.check(dir)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: error is '%v', expected '%s'", test.name, err, test.err)
+		}
+	}
+
+	// Holidays without a chance are always shown
+	var cal = patternCalendar{Patterns: []string{"plain"}, Holidays: []patternHoliday{christmas}}
+	if err := cal.check(dir); err != nil {
+		t.Fatal(err)
+	}
+	if cal.Holidays[0].Chance != 1 {
+		t.Errorf("chance of a holiday without chance is %g, expected 1", cal.Holidays[0].Chance)
+	}
+}
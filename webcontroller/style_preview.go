@@ -0,0 +1,227 @@
+package webcontroller
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"path"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/util"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Theme previews are miniatures of a page, drawn with the colours of a theme.
+// Text is drawn as bars, so no fonts are needed. The previews are rendered as
+// SVG, or as PNG for places where SVG can't be used
+
+const (
+	previewWidth  = 240
+	previewHeight = 150
+	previewScale  = 2 // The PNG is rendered at twice the size, for HiDPI screens
+)
+
+// previewRect is a rectangle in a preview. Rectangles are drawn in order,
+// values which are not colours or gradients are not drawn
+type previewRect struct {
+	x, y, w, h int
+	fill       CSS
+}
+
+// previewRects returns the page layout of the preview: the header on the
+// background, and the page body with text, a link, buttons and a card with a
+// chart
+func previewRects(s styleSheet) []previewRect {
+	s = s.withDefaults()
+	return []previewRect{
+		{0, 0, 240, 150, s.Background},
+		{0, 0, 240, 20, s.Navigation},
+		{12, 7, 60, 6, s.BackgroundText},
+		{180, 7, 48, 6, s.BackgroundText},
+
+		{20, 26, 200, 124, s.BodyBackground},
+		{32, 38, 110, 6, s.BodyText},
+		{32, 50, 170, 4, s.BodyText},
+		{32, 58, 140, 4, s.BodyText},
+		{32, 66, 60, 4, s.Link},
+		{20, 78, 200, 1, s.Separator},
+
+		{32, 86, 54, 16, s.Input},
+		{40, 92, 38, 4, s.InputText},
+		{93, 86, 54, 16, s.HighlightBackground},
+		{101, 92, 38, 4, s.HighlightText},
+		{154, 86, 54, 16, s.Danger},
+		{162, 92, 38, 4, s.DangerText},
+
+		{32, 110, 176, 32, s.CardColor},
+		{40, 126, 12, 10, s.Chart1},
+		{56, 120, 12, 16, s.Chart2},
+		{72, 115, 12, 21, s.Chart3},
+		{96, 118, 100, 4, s.BodyText},
+		{96, 126, 76, 4, s.BodyText},
+	}
+}
+
+// previewLayer is a variant of the theme, drawn in a part of the preview.
+// Dynamic themes show the dark variant on the left and the light variant on
+// the right
+type previewLayer struct {
+	clipX, clipW int
+	rects        []previewRect
+}
+
+func previewLayers(t resolvedTheme) (layers []previewLayer) {
+	var variants = t.variants()
+	var w = previewWidth / len(variants)
+	for i, v := range variants {
+		layers = append(layers, previewLayer{i * w, w, previewRects(v.style)})
+	}
+	return layers
+}
+
+// themePreviewSVG renders the preview of a theme as SVG
+func themePreviewSVG(t resolvedTheme) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n",
+		previewWidth, previewHeight, previewWidth, previewHeight,
+	)
+	fmt.Fprintf(&b, "<title>%s</title>\n", html.EscapeString(t.title))
+
+	for i, layer := range previewLayers(t) {
+		fmt.Fprintf(&b, `<clipPath id="c%d"><rect x="%d" y="0" width="%d" height="%d"/></clipPath>`+"\n", i, layer.clipX, layer.clipW, previewHeight)
+		fmt.Fprintf(&b, `<g clip-path="url(#c%d)">`+"\n", i)
+		for j, r := range layer.rects {
+			var fill string
+			switch v := r.fill.(type) {
+			case Color:
+				fill = v.CSS()
+			case Gradient:
+				var id = fmt.Sprintf("g%d_%d", i, j)
+				writeSVGGradient(&b, id, v)
+				fill = "url(#" + id + ")"
+			default:
+				continue
+			}
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"/>`+"\n", r.x, r.y, r.w, r.h, html.EscapeString(fill))
+		}
+		b.WriteString("</g>\n")
+	}
+	b.WriteString("</svg>\n")
+	return b.Bytes()
+}
+
+// themePreviewPNG renders the preview of a theme as PNG. The preview only
+// consists of rectangles, so it's drawn pixel by pixel
+func themePreviewPNG(t resolvedTheme) ([]byte, error) {
+	var img = image.NewRGBA(image.Rect(0, 0, previewWidth*previewScale, previewHeight*previewScale))
+
+	for _, layer := range previewLayers(t) {
+		for _, r := range layer.rects {
+			switch r.fill.(type) {
+			case Color, Gradient:
+			default:
+				continue
+			}
+
+			var x0, x1 = max(r.x, layer.clipX) * previewScale, min(r.x+r.w, layer.clipX+layer.clipW) * previewScale
+			for y := r.y * previewScale; y < (r.y+r.h)*previewScale; y++ {
+				for x := x0; x < x1; x++ {
+					var c, alpha = previewFillAt(r, (float64(x)+.5)/previewScale, (float64(y)+.5)/previewScale)
+					var below = img.RGBAAt(x, y)
+					var rgb = blend(c, RGB{below.R, below.G, below.B}, alpha)
+					img.SetRGBA(x, y, color.RGBA{rgb.R, rgb.G, rgb.B, 0xff})
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// alphaOf returns the colour without transparency, and its opacity
+func alphaOf(c Color) (RGB, float64) {
+	switch c := c.(type) {
+	case RGBA:
+		return c.RGB(), c.A
+	case HSLA:
+		return c.RGB(), c.Alpha
+	}
+	return c.RGB(), 1
+}
+
+// previewFillAt returns the colour of a rectangle at a point. Gradients follow
+// the CSS gradient line, and are interpolated in OKLab like in theme.css
+func previewFillAt(r previewRect, x, y float64) (RGB, float64) {
+	var g, ok = r.fill.(Gradient)
+	if !ok {
+		return alphaOf(r.fill.(Color))
+	}
+	if len(g.Colors) == 1 {
+		return alphaOf(g.Colors[0])
+	}
+
+	// The gradient line goes through the centre of the rectangle, at 0
+	// degrees it points up. Its length is chosen so the corners get the
+	// first and the last colour
+	var angle = float64(g.Angle) * math.Pi / 180
+	var dx, dy = math.Sin(angle), -math.Cos(angle)
+	var length = math.Abs(float64(r.w)*dx) + math.Abs(float64(r.h)*dy)
+	var cx, cy = float64(r.x) + float64(r.w)/2, float64(r.y) + float64(r.h)/2
+	var pos = clamp(((x-cx)*dx+(y-cy)*dy)/length+.5, 0, 1) * float64(len(g.Colors)-1)
+
+	var i = min(int(pos), len(g.Colors)-2)
+	var a, aAlpha = alphaOf(g.Colors[i])
+	var b, bAlpha = alphaOf(g.Colors[i+1])
+	var t = pos - float64(i)
+	return MixOKLab(a, b, t).RGB(), aAlpha + (bAlpha-aAlpha)*t
+}
+
+// serveThemePreview renders a preview of the theme which theme.css would
+// return for the same request. The file extension chooses SVG or PNG
+func (wc *WebController) serveThemePreview(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	t, err := wc.themeFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ext = path.Ext(r.URL.Path)
+	if ext == ".png" {
+		w.Header().Set("Content-Type", "image/png")
+	} else {
+		w.Header().Set("Content-Type", "image/svg+xml")
+	}
+
+	// Like theme.css the preview only depends on the URL and the style
+	// cookies. Rendering the PNG is expensive, so the ETag is computed from
+	// the theme instead of the image, and checked before anything is drawn
+	varyThemeCookies(w, r)
+	w.Header().Set("Cache-Control", "public, no-cache")
+	if checkETag(w, r, etagFor([]byte(ext+":"+t.key))) || r.Method == "HEAD" {
+		return
+	}
+
+	var body []byte
+	if ext == ".png" {
+		if body, err = themePreviewPNG(t); err != nil {
+			log.Error("Failed to render theme preview of %s: %s", t.name, err)
+			http.Error(w, "Failed to render theme preview", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		body = themePreviewSVG(t)
+	}
+	if _, err = w.Write(body); err != nil && !util.IsNetError(err) {
+		log.Error("Error writing response: %s", err)
+	}
+}
@@ -0,0 +1,335 @@
+package webcontroller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"fornaxian.tech/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// defaultTheme is used when no theme is selected, or when the selected theme
+// does not exist
+const defaultTheme = "nord"
+
+// themeInfo describes a theme in the theme picker
+type themeInfo struct {
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url,omitempty"` // Where the theme came from
+
+	// Dynamic themes have a dark and a light variant, the variant is chosen
+	// based on the colour scheme preferred by the operating system. These
+	// are the names of the variants
+	Dark  string `json:"dark,omitempty"`
+	Light string `json:"light,omitempty"`
+
+	// The dynamic theme this theme is a variant of
+	VariantOf string `json:"variant_of,omitempty"`
+
+	// If the hue of the theme can be changed
+	Hue bool `json:"hue"`
+
+	// Hidden themes can be used, but are not shown in the theme picker
+	Hidden bool `json:"-"`
+}
+
+// theme is a theme in the registry. Dynamic themes have no style of their own
+type theme struct {
+	themeInfo
+	style styleSheet
+}
+
+func (t theme) dynamic() bool { return t.Dark != "" }
+
+// themeFile is the format of the theme files in the themes directory of the
+// resource directory. The name of the theme is the name of the file. Besides
+// the metadata a theme file has the same fields as a custom theme
+type themeFile struct {
+	Title       string `json:"title" toml:"title"`
+	Description string `json:"description" toml:"description"`
+	URL         string `json:"url" toml:"url"`
+	Dark        string `json:"dark" toml:"dark"`
+	Light       string `json:"light" toml:"light"`
+	Hue         bool   `json:"hue" toml:"hue"`
+	Hidden      bool   `json:"hidden" toml:"hidden"`
+
+	themeDefinition
+}
+
+// themeRegistry holds all themes which can be selected. It's replaced as a
+// whole when the config is reloaded
+type themeRegistry struct {
+	themes  map[string]theme
+	order   []string          // Names in the order they are listed
+	aliases map[string]string // Old theme names
+
+	// Changes every time the themes are loaded. It's part of the key of the
+	// themes resolved from the registry, so responses which are cached by
+	// that key are refreshed when the theme files change
+	generation int64
+}
+
+func (reg *themeRegistry) add(t theme) {
+	if _, ok := reg.themes[t.Name]; !ok {
+		reg.order = append(reg.order, t.Name)
+	}
+	reg.themes[t.Name] = t
+}
+
+// get returns a theme by name or alias
+func (reg *themeRegistry) get(name string) (theme, bool) {
+	if alias, ok := reg.aliases[name]; ok {
+		name = alias
+	}
+	t, ok := reg.themes[name]
+	return t, ok
+}
+
+// baseStyle returns the style sheet a custom theme can be based on. For dynamic
+// themes that's the dark variant
+func (reg *themeRegistry) baseStyle(name string) (styleSheet, error) {
+	if name == "" {
+		name = defaultTheme
+	}
+	t, ok := reg.get(name)
+	if !ok {
+		return styleSheet{}, fmt.Errorf("base theme '%s' does not exist", name)
+	}
+	if t.dynamic() {
+		t = reg.themes[t.Dark]
+	}
+	return t.style, nil
+}
+
+// resolvedTheme is a theme with the hue applied, ready to be rendered
+type resolvedTheme struct {
+	name  string
+	title string
+	style styleSheet
+	light *styleSheet // The light variant of dynamic themes
+
+	// The inputs the theme was resolved from, it identifies the theme
+	// without rendering it
+	key string
+}
+
+// variants returns the style sheets of the theme. Dynamic themes have a dark
+// and a light variant, other themes have one unnamed variant
+func (t resolvedTheme) variants() []themeVariant {
+	if t.light == nil {
+		return []themeVariant{{"", t.style}}
+	}
+	return []themeVariant{{"dark", t.style}, {"light", *t.light}}
+}
+
+type themeVariant struct {
+	name  string
+	style styleSheet
+}
+
+func (t resolvedTheme) css() template.CSS {
+	if t.light != nil {
+		return template.CSS(t.style.withLight(*t.light))
+	}
+	return template.CSS(t.style.String())
+}
+
+// printCSS renders the print style sheet of the theme for all media, for
+// pages in print mode. Dynamic themes are printed with their light variant
+func (t resolvedTheme) printCSS() template.CSS {
+	if t.light != nil {
+		return template.CSS(t.light.printSheet())
+	}
+	return template.CSS(t.style.printSheet())
+}
+
+// resolve looks up a theme and applies the hue. Unknown themes are replaced by
+// the default theme
+func (reg *themeRegistry) resolve(name string, hue int) resolvedTheme {
+	t, ok := reg.get(name)
+	if !ok {
+		if name != "" {
+			log.Debug("Unknown theme '%s', using %s", name, defaultTheme)
+		}
+		t = reg.themes[defaultTheme]
+	}
+
+	if !t.Hue || hue < 0 || hue > 360 {
+		hue = -1
+	}
+	// Changing the hue can make text unreadable, the lightness of the text is
+	// corrected where needed
+	var withHue = func(s styleSheet) styleSheet {
+		if hue != -1 {
+			return s.withHue(hue).withContrast(contrastAA)
+		}
+		return s
+	}
+
+	var res = resolvedTheme{name: t.Name, title: t.Title, key: fmt.Sprintf("%s:%d:%d", t.Name, hue, reg.generation)}
+	if t.dynamic() {
+		var light = withHue(reg.themes[t.Light].style)
+		res.style, res.light = withHue(reg.themes[t.Dark].style), &light
+	} else {
+		res.style = withHue(t.style)
+	}
+	return res
+}
+
+// list returns the themes for the theme picker
+func (reg *themeRegistry) list() (list []themeInfo) {
+	list = []themeInfo{}
+	for _, name := range reg.order {
+		if t := reg.themes[name]; !t.Hidden {
+			list = append(list, t.themeInfo)
+		}
+	}
+	return list
+}
+
+// loadThemeFile adds a theme from a theme file to the registry
+func (reg *themeRegistry) loadThemeFile(path string) error {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file themeFile
+	if err = decodeThemeSource(src, &file); err != nil {
+		return err
+	}
+
+	var name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	var t = theme{themeInfo: themeInfo{
+		Name:        name,
+		Title:       file.Title,
+		Description: file.Description,
+		URL:         file.URL,
+		Dark:        file.Dark,
+		Light:       file.Light,
+		Hue:         file.Hue,
+		Hidden:      file.Hidden,
+	}}
+	if t.Title == "" {
+		t.Title = name
+	}
+
+	if (file.Dark == "") != (file.Light == "") {
+		return errors.New("dynamic themes need both a dark and a light variant")
+	} else if !t.dynamic() {
+		if t.style, err = file.themeDefinition.styleSheet(reg); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := reg.themes[name]; ok {
+		log.Info("Theme file %s replaces the built-in theme", path)
+	}
+	reg.add(t)
+	return nil
+}
+
+// check removes dynamic themes with variants which don't exist, and links the
+// variants to their dynamic theme
+func (reg *themeRegistry) check() (errs []error) {
+	for _, name := range reg.order {
+		var t = reg.themes[name]
+		if !t.dynamic() {
+			continue
+		}
+		dark, darkOK := reg.themes[t.Dark]
+		light, lightOK := reg.themes[t.Light]
+		if !darkOK || !lightOK || dark.dynamic() || light.dynamic() {
+			errs = append(errs, fmt.Errorf("theme '%s': variants '%s' and '%s' must exist and can't be dynamic themes", name, t.Dark, t.Light))
+			delete(reg.themes, name)
+			continue
+		}
+		dark.VariantOf, light.VariantOf = name, name
+		reg.themes[t.Dark], reg.themes[t.Light] = dark, light
+	}
+
+	var order = reg.order[:0]
+	for _, name := range reg.order {
+		if _, ok := reg.themes[name]; ok {
+			order = append(order, name)
+		}
+	}
+	reg.order = order
+	return errs
+}
+
+// loadThemes creates a registry with the built-in themes and the theme files
+// in the themes directory of the resource directory. Theme files which can't
+// be loaded are skipped, the errors are returned
+func loadThemes(resourceDir string) (reg *themeRegistry, err error) {
+	reg = &themeRegistry{
+		themes:     make(map[string]theme),
+		aliases:    map[string]string{"snowstorm": "nord_light"},
+		generation: time.Now().UnixNano(),
+	}
+	for _, t := range builtinThemes {
+		reg.add(t)
+	}
+
+	var errs []error
+	files, _ := filepath.Glob(filepath.Join(resourceDir, "themes", "*"))
+	sort.Strings(files)
+	for _, path := range files {
+		if ext := filepath.Ext(path); ext != ".json" && ext != ".toml" {
+			continue
+		}
+		if err := reg.loadThemeFile(path); err != nil {
+			errs = append(errs, fmt.Errorf("theme file %s: %w", path, err))
+		}
+	}
+	errs = append(errs, reg.check()...)
+
+	// A theme file could have replaced the default theme or its variants with
+	// something which does not work. Then the built-in versions are restored
+	if _, ok := reg.themes[defaultTheme]; !ok {
+		errs = append(errs, fmt.Errorf("the default theme '%s' is missing, using the built-in version", defaultTheme))
+		var names = map[string]bool{defaultTheme: true}
+		for _, t := range builtinThemes {
+			if t.Name == defaultTheme {
+				names[t.Dark], names[t.Light] = true, true
+			}
+		}
+		for _, t := range builtinThemes {
+			if names[t.Name] {
+				reg.add(t)
+			}
+		}
+		reg.check()
+	}
+	return reg, errors.Join(errs...)
+}
+
+// loadThemes loads the themes from the resource directory. Errors are logged,
+// a broken theme file should not keep the server from starting
+func (wc *WebController) loadThemes() {
+	reg, err := loadThemes(wc.config().ResourceDir)
+	if err != nil {
+		log.Error("Failed to load themes: %s", err)
+	}
+	wc.themes.Store(reg)
+}
+
+// serveThemesJSON lists the themes for the theme picker on the appearance page
+func (wc *WebController) serveThemesJSON(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	body, err := json.Marshal(wc.themes.Load().list())
+	if err != nil {
+		log.Error("Failed to encode theme list: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeCached(w, r, body, false)
+}
@@ -2,6 +2,7 @@ package webcontroller
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"fornaxian.tech/log"
@@ -29,10 +31,23 @@ type TemplateData struct {
 	PixelAPI      pixelapi.PixelAPI
 	Hostname      template.HTML
 
+	// Sections of the admin panel the user is allowed to access
+	AdminSections []adminSection
+
+	// Maintenance mode and scheduled announcements, shown in the page header
+	Maintenance maintenanceStatus
+
+	// Nonce which needs to be added to inline scripts for the content security
+	// policy. Use the nonce template function to render the attribute
+	CSPNonce string
+
 	// Only used on file viewer page
 	Title  string
 	OGData ogData
 
+	// Style sheet of branded pages, the user's theme is used when empty
+	ThemeURI template.URL
+
 	Other    interface{}
 	URLQuery url.Values
 
@@ -41,17 +56,26 @@ type TemplateData struct {
 }
 
 func (wc *WebController) newTemplateData(w http.ResponseWriter, r *http.Request) (t *TemplateData) {
+	// During maintenance the template data is made before the handler runs,
+	// to check if the user is an admin. Every caller gets its own copy
+	if td, ok := r.Context().Value(templateDataKey{}).(*TemplateData); ok {
+		var data = *td
+		return &data
+	}
+
 	t = &TemplateData{
 		tpm:           wc.templates,
 		Authenticated: false,
 		UserAgent:     r.UserAgent(),
-		APIEndpoint:   template.URL(wc.config.APIURLExternal),
+		APIEndpoint:   template.URL(wc.config().APIURLExternal),
 
 		// Use the user's IP address for making requests
-		PixelAPI: wc.api.RealIP(util.RemoteAddress(r)).RealAgent(r.UserAgent()),
+		PixelAPI: wc.api().RealIP(util.RemoteAddress(r)).RealAgent(r.UserAgent()),
 
-		Hostname: template.HTML(wc.hostname),
-		URLQuery: r.URL.Query(),
+		Hostname:    template.HTML(wc.hostname),
+		URLQuery:    r.URL.Query(),
+		Maintenance: wc.maintenance.status(),
+		CSPNonce:    cspNonce(r),
 	}
 
 	// If the user is authenticated we'll indentify him and put the user info
@@ -66,7 +90,7 @@ func (wc *WebController) newTemplateData(w http.ResponseWriter, r *http.Request)
 
 			if err.Error() == "authentication_required" || err.Error() == "authentication_failed" {
 				// Disable API authentication
-				t.PixelAPI = wc.api.RealIP(util.RemoteAddress(r)).RealAgent(r.UserAgent())
+				t.PixelAPI = wc.api().RealIP(util.RemoteAddress(r)).RealAgent(r.UserAgent())
 
 				// Remove the authentication cookie
 				log.Debug("Deleting invalid API key")
@@ -75,7 +99,7 @@ func (wc *WebController) newTemplateData(w http.ResponseWriter, r *http.Request)
 					Value:   "",
 					Path:    "/",
 					Expires: time.Unix(0, 0),
-					Domain:  wc.config.SessionCookieDomain,
+					Domain:  wc.config().SessionCookieDomain,
 				})
 				http.SetCookie(w, &http.Cookie{
 					Name:    "pd_auth_key",
@@ -90,6 +114,7 @@ func (wc *WebController) newTemplateData(w http.ResponseWriter, r *http.Request)
 
 		// Authentication succeeded
 		t.Authenticated = true
+		t.AdminSections = wc.adminSections(t.User)
 	}
 
 	return t
@@ -98,36 +123,98 @@ func (wc *WebController) newTemplateData(w http.ResponseWriter, r *http.Request)
 // TemplateManager parses templates and provides utility functions to the
 // templates' scripting language
 type TemplateManager struct {
-	tpl *template.Template
+	state  atomic.Pointer[templateState]
+	assets atomic.Pointer[assetManifest]
+}
 
-	// Config
+// templateSettings is the configuration of the template manager
+type templateSettings struct {
 	resourceDir         string
 	externalAPIEndpoint string
+	docsPrefix          string
 	debugModeEnabled    bool
 }
 
-// NewTemplateManager creates a new template manager
-func NewTemplateManager(resourceDir, externalAPIEndpoint string, debugMode bool) *TemplateManager {
-	return &TemplateManager{
+// templateState holds the parsed templates and the settings they were parsed
+// with. It is replaced as a whole, so requests never see templates which don't
+// belong to the settings
+type templateState struct {
+	settings templateSettings
+	tpl      *template.Template
+	markdown *markdownCache
+}
+
+// NewTemplateManager creates a new template manager. The docs prefix is the
+// URL path the documentation pages are served under
+func NewTemplateManager(resourceDir, externalAPIEndpoint, docsPrefix string, debugMode bool) *TemplateManager {
+	var tm = &TemplateManager{}
+	tm.state.Store(&templateState{settings: templateSettings{
 		resourceDir:         resourceDir,
 		externalAPIEndpoint: externalAPIEndpoint,
+		docsPrefix:          docsPrefix,
 		debugModeEnabled:    debugMode,
-	}
+	}})
+	return tm
 }
 
 // ParseTemplates parses the templates in the template directory which is
 // defined in the config file.
 // If silent is false it will print an info log message for every template found
-func (tm *TemplateManager) ParseTemplates(silent bool) {
+func (tm *TemplateManager) ParseTemplates(silent bool) error {
+	var settings = tm.settings()
+	tpl, docs, err := tm.parse(settings, silent)
+	tm.store(settings, tpl, docs)
+	return errors.Join(err, tm.loadAssets())
+}
+
+// Reload changes the settings of the template manager and parses the templates
+// again. If the templates fail to parse the old templates and settings are kept
+func (tm *TemplateManager) Reload(resourceDir, externalAPIEndpoint, docsPrefix string, debugMode bool) error {
+	var settings = templateSettings{
+		resourceDir:         resourceDir,
+		externalAPIEndpoint: externalAPIEndpoint,
+		docsPrefix:          docsPrefix,
+		debugModeEnabled:    debugMode,
+	}
+
+	tpl, docs, err := tm.parse(settings, true)
+	if err != nil {
+		return err
+	}
+	tm.store(settings, tpl, docs)
+	return tm.loadAssets()
+}
+
+// store activates a new set of templates. Everything which was rendered with
+// the old templates is discarded
+func (tm *TemplateManager) store(settings templateSettings, tpl *template.Template, docs map[string]markdownDoc) {
+	tm.state.Store(&templateState{
+		settings: settings,
+		tpl:      tpl,
+		markdown: newMarkdownCache(docs),
+	})
+}
+
+// settings returns the settings of the active templates
+func (tm *TemplateManager) settings() templateSettings { return tm.state.Load().settings }
+
+// markdown returns the markdown documents of the active templates
+func (tm *TemplateManager) markdown() *markdownCache { return tm.state.Load().markdown }
+
+func (tm *TemplateManager) parse(settings templateSettings, silent bool) (*template.Template, map[string]markdownDoc, error) {
 	var err error
+	var errs []error
 	var templatePaths []string
+	var docs = make(map[string]markdownDoc)
+	var resourceDir = settings.resourceDir
 	tpl := template.New("")
 
 	// Import template functions
 	tpl.Funcs(template.FuncMap{
-		"cacheID":        tm.cacheID,
+		"asset":          tm.asset,
 		"debugMode":      tm.debugMode,
 		"apiUrl":         tm.apiURL,
+		"docURL":         tm.docURL,
 		"pageNr":         tm.pageNr,
 		"add":            tm.add,
 		"sub":            tm.sub,
@@ -139,10 +226,11 @@ func (tm *TemplateManager) ParseTemplates(silent bool) {
 		"noescape":       tm.noEscape,
 		"noescapeJS":     tm.noEscapeJS,
 		"slashes":        tm.slashes,
+		"nonce":          tm.nonceAttr,
 	})
 
 	// Parse dynamic templates
-	if err = filepath.Walk(tm.resourceDir+"/template", func(path string, f os.FileInfo, err error) error {
+	if err = filepath.Walk(resourceDir+"/template", func(path string, f os.FileInfo, err error) error {
 		if f == nil || f.IsDir() {
 			return nil
 		}
@@ -154,14 +242,16 @@ func (tm *TemplateManager) ParseTemplates(silent bool) {
 		return nil
 	}); err != nil {
 		log.Error("Failed to parse templates: %s", err)
+		errs = append(errs, err)
 	}
 	if _, err = tpl.ParseFiles(templatePaths...); err != nil {
 		log.Error("Template parsing failed: %v", err)
+		errs = append(errs, err)
 	}
 
 	// Parse static resources
 	var file []byte
-	if err = filepath.Walk(tm.resourceDir+"/include", func(path string, f os.FileInfo, err error) error {
+	if err = filepath.Walk(resourceDir+"/include", func(path string, f os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("walk err: %w", err)
 		}
@@ -181,9 +271,38 @@ func (tm *TemplateManager) ParseTemplates(silent bool) {
 			file = []byte("data:image/webp;base64," + base64.StdEncoding.EncodeToString(file))
 		}
 
+		// Documents in the markdown directory are named after their path in
+		// that directory, so documents in subdirectories get unique names
+		var name = f.Name()
+		if rel, err := filepath.Rel(resourceDir+"/include/md", path); err == nil && !strings.HasPrefix(rel, "..") {
+			name = filepath.ToSlash(rel)
+		}
+
+		if strings.HasSuffix(path, ".md") {
+			// Markdown documents can have front matter, which is not part of
+			// the template
+			doc, err := parseMarkdownDoc(file)
+			if err != nil {
+				// A broken document should not take the other templates
+				// down with it, it's skipped
+				log.Error("Failed to parse '%s', document is skipped: %s", path, err)
+				return nil
+			}
+			doc.modTime = f.ModTime()
+			docs[name] = doc
+
+			if doc.Meta.NoExec {
+				if !silent {
+					log.Info("Markdown document parsed: %s", path)
+				}
+				return nil
+			}
+			file = doc.body
+		}
+
 		// Wrap the resources in a template definition
 		if _, err = tpl.Parse(
-			`{{define "` + f.Name() + `"}}` + string(file) + `{{end}}`,
+			`{{define "` + name + `"}}` + string(file) + `{{end}}`,
 		); err != nil {
 			return fmt.Errorf("failed to parse '%s': %w", path, err)
 		}
@@ -195,38 +314,37 @@ func (tm *TemplateManager) ParseTemplates(silent bool) {
 		return nil
 	}); err != nil {
 		log.Error("Failed to parse templates: %s", err)
+		errs = append(errs, err)
 	}
 
-	tm.tpl = tpl
+	return tpl, docs, errors.Join(errs...)
 }
 
 // Run runs a template by name
 func (tm *TemplateManager) Run(w io.Writer, r *http.Request, name string, data any) (err error) {
-	if tm.debugModeEnabled {
+	if tm.debugMode() {
 		tm.ParseTemplates(true)
 	}
 	if r.Method == "HEAD" {
 		return nil
 	}
-	return tm.tpl.ExecuteTemplate(w, name, data)
+	return tm.state.Load().tpl.ExecuteTemplate(w, name, data)
 }
 
 // Template functions. These can be called from within the template to execute
 // more specialized actions
 
-// The cache ID is used to invalidate caches when the webserver is restarted.
-// It's rounded to a full hour to prevent cached from being emptied too often if
-// the server is regularly restarted
-var cacheID = time.Now().Unix() / 3600
-
-func (tm *TemplateManager) cacheID() int64 {
-	return cacheID
-}
 func (tm *TemplateManager) debugMode() bool {
-	return tm.debugModeEnabled
+	return tm.settings().debugModeEnabled
 }
 func (tm *TemplateManager) apiURL() string {
-	return tm.externalAPIEndpoint
+	return tm.settings().externalAPIEndpoint
+}
+
+// docURL returns the URL of a documentation page, name is the path of the
+// document without the .md extension
+func (tm *TemplateManager) docURL(name string) string {
+	return tm.settings().docsPrefix + "/" + name
 }
 func (tm *TemplateManager) pageNr(s string) (nr int) {
 	// Atoi returns 0 on error, which is fine for page numbers
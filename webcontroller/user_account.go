@@ -61,7 +61,7 @@ func (wc *WebController) serveLogout(
 	p httprouter.Params,
 ) {
 	if key, err := wc.getAPIKey(r); err == nil {
-		var api = wc.api.Login(key)
+		var api = wc.api().Login(key)
 		if err = api.DeleteUserSession(key); err != nil {
 			log.Warn("logout failed for session '%s': %s", key, err)
 		}
@@ -72,22 +72,12 @@ func (wc *WebController) serveLogout(
 
 func (wc *WebController) registerForm(td *TemplateData, r *http.Request) (f Form) {
 	var err error
-	// This only runs on the first request
-	if wc.captchaSiteKey == "" {
-		capt, err := td.PixelAPI.GetMiscRecaptcha()
-		if err != nil {
-			log.Error("Error getting recaptcha key: %s", err)
-			f.SubmitMessages = []template.HTML{
-				"An internal server error had occurred. Registration is " +
-					"unavailable at the moment. Please return later",
-			}
-			return f
-		}
-		if capt.SiteKey == "" {
-			wc.captchaSiteKey = "none"
-		} else {
-			wc.captchaSiteKey = capt.SiteKey
+	if wc.captchaKey() == "" {
+		f.SubmitMessages = []template.HTML{
+			"An internal server error had occurred. Registration is " +
+				"unavailable at the moment. Please return later",
 		}
+		return f
 	}
 
 	// Construct the form
@@ -238,7 +228,7 @@ func (wc *WebController) sessionCookie(session pixelapi.UserSession) *http.Cooki
 		Value:   session.AuthKey.String(),
 		Path:    "/",
 		Expires: time.Now().AddDate(50, 0, 0),
-		Domain:  wc.config.SessionCookieDomain,
+		Domain:  wc.config().SessionCookieDomain,
 
 		// Strict means the Cookie will only be sent when the user
 		// reaches a page by a link from the same domain. Lax means any
@@ -355,7 +345,7 @@ func (wc *WebController) serveEmailConfirm(
 	var err error
 	var status string
 
-	err = wc.api.PutUserEmailResetConfirm(r.FormValue("key"))
+	err = wc.api().PutUserEmailResetConfirm(r.FormValue("key"))
 	if err != nil && err.Error() == "not_found" {
 		status = "not_found"
 	} else if err != nil {
@@ -2,21 +2,18 @@ package webcontroller
 
 import (
 	"bytes"
+	"crypto/rand"
 	"errors"
 	"fmt"
-	"html/template"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"fornaxian.tech/log"
-	"fornaxian.tech/pixeldrain_api_client/pixelapi"
 	"fornaxian.tech/util"
 	"github.com/julienschmidt/httprouter"
-	blackfriday "github.com/russross/blackfriday/v2"
 )
 
 type Config struct {
@@ -27,27 +24,82 @@ type Config struct {
 	ResourceDir         string `toml:"resource_dir"`
 	DebugMode           bool   `toml:"debug_mode"`
 	ProxyAPIRequests    bool   `toml:"proxy_api_requests"`
-	MaintenanceMode     bool   `toml:"maintenance_mode"`
+
+	// Security headers. The CSP mode can be off, report_only or enforce
+	CSPMode                 string              `toml:"csp_mode"`
+	CSPSources              map[string][]string `toml:"csp_sources"`
+	ReferrerPolicy          string              `toml:"referrer_policy"`
+	PermissionsPolicy       string              `toml:"permissions_policy"`
+	CrossOriginOpenerPolicy string              `toml:"cross_origin_opener_policy"`
+
+	// Maintenance settings which can be changed at runtime through the admin
+	// panel. The config values are used when the server starts
+	MaintenanceMode       bool           `toml:"maintenance_mode"`
+	MaintenanceReadOnly   bool           `toml:"maintenance_read_only"`
+	MaintenanceBypassIPs  []string       `toml:"maintenance_bypass_ips"`
+	MaintenanceRetryAfter int            `toml:"maintenance_retry_after"`
+	Announcements         []Announcement `toml:"announcements"`
+
+	// Usernames mapped to the admin roles they have. Admins who are not
+	// listed here get the superadmin role
+	AdminRoles map[string][]string `toml:"admin_roles"`
+
+	// URL path the markdown documents are served under, and the path of the
+	// documentation index. An empty prefix serves documents from the root
+	DocsPrefix string `toml:"docs_prefix"`
+	DocsIndex  string `toml:"docs_index"`
+
+	// Paths which crawlers are asked not to visit in robots.txt
+	RobotsDisallow []string `toml:"robots_disallow"`
+
+	// Fields of /.well-known/security.txt. The file is only served when there
+	// is at least one contact. When no expiry date is set the file expires six
+	// months after it was requested
+	SecurityContact            []string  `toml:"security_contact"`
+	SecurityExpires            time.Time `toml:"security_expires"`
+	SecurityEncryption         string    `toml:"security_encryption"`
+	SecurityPolicy             string    `toml:"security_policy"`
+	SecurityAcknowledgments    string    `toml:"security_acknowledgments"`
+	SecurityPreferredLanguages string    `toml:"security_preferred_languages"`
+
+	// Where /.well-known/change-password redirects to
+	ChangePasswordURL string `toml:"change_password_url"`
+
+	// Key for signing the logo paths in the theme URLs of branded directories.
+	// A random key is used when empty
+	BrandImageKey string `toml:"brand_image_key"`
 }
 
 // WebController controls how requests are handled and makes sure they have
 // proper context when running
 type WebController struct {
-	templates *TemplateManager
-	config    Config
+	prefix      string // Path prefix of all routes
+	templates   *TemplateManager
+	runtime     atomic.Pointer[runtimeConfig]
+	maintenance *maintenanceState
+	search      atomic.Pointer[searchIndex]
+	themes      atomic.Pointer[themeRegistry]
+	patterns    atomic.Pointer[patternCalendar]
+	brandImages brandImageCache
+	router      *httprouter.Router
+
+	// Signs the logo paths in the theme URLs of branded directories when no
+	// key is configured
+	brandImageKey []byte
+
+	// Public pages from the route table, listed in the sitemap. And the paths
+	// of the documentation pages which got a route of their own
+	sitemapPaths []string
+	docRoutes    map[string]bool
+
+	// If the API proxy routes were registered. They can only be registered
+	// when the server starts
+	proxyRegistered bool
 
 	// Server hostname, displayed in the footer of every web page
 	hostname string
 
-	// page-specific variables
-	captchaSiteKey string
-
 	httpClient *http.Client
-
-	// API client to use for all requests. If the user is authenticated you
-	// should call Login() on this object. Calling Login will create a copy and
-	// not alter the original PixelAPI, but it will use the same HTTP Transport
-	api pixelapi.PixelAPI
 }
 
 // New initializes a new WebController by registering all the request handlers
@@ -55,29 +107,51 @@ type WebController struct {
 func New(r *httprouter.Router, prefix string, conf Config) (wc *WebController) {
 	var err error
 	wc = &WebController{
-		config:     conf,
-		httpClient: &http.Client{Timeout: time.Minute * 10},
-		api:        pixelapi.New(conf.APIURLInternal),
+		prefix:      prefix,
+		router:      r,
+		docRoutes:   make(map[string]bool),
+		maintenance: newMaintenanceState(conf),
+		httpClient:  &http.Client{Timeout: time.Minute * 10},
+	}
+
+	wc.brandImageKey = make([]byte, 32)
+	if _, err = rand.Read(wc.brandImageKey); err != nil {
+		panic(err)
 	}
 
-	if conf.APISocketPath != "" {
-		wc.api = wc.api.UnixSocketPath(conf.APISocketPath)
+	rc, err := wc.newRuntimeConfig(conf)
+	if err != nil {
+		panic(err)
 	}
+	wc.runtime.Store(rc)
+
+	checkAdminRoles(conf.AdminRoles)
 
-	wc.templates = NewTemplateManager(conf.ResourceDir, conf.APIURLExternal, conf.DebugMode)
+	wc.templates = NewTemplateManager(conf.ResourceDir, conf.APIURLExternal, prefix+conf.DocsPrefix, conf.DebugMode)
 	wc.templates.ParseTemplates(false)
+	wc.loadThemes()
+	wc.loadPatterns()
 
 	if wc.hostname, err = os.Hostname(); err != nil {
 		panic(fmt.Errorf("could not get hostname: %s", err))
 	}
 
-	// Serve static files
-	var fs = http.FileServer(http.Dir(conf.ResourceDir + "/static"))
+	// Serve static files. The resource directory is read on every request so
+	// it can be changed when the config is reloaded
 	var resourceHandler = func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		// Cache resources for a year
-		w.Header().Set("Cache-Control", "public, max-age=31536000")
-		r.URL.Path = p.ByName("filepath")
-		fs.ServeHTTP(w, r)
+		if hash, ok := wc.templates.assetHash(p.ByName("filepath")); ok {
+			w.Header().Set("ETag", `"`+hash+`"`)
+			if r.URL.Query().Get("v") == hash {
+				// The URL changes when the file changes, so this response can
+				// be cached forever
+				w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			} else {
+				w.Header().Set("Cache-Control", "public, no-cache")
+			}
+		} else {
+			w.Header().Set("Cache-Control", "public, no-cache")
+		}
+		serveStaticFile(w, r, wc.config().ResourceDir+"/static", p.ByName("filepath"))
 	}
 	r.HEAD(prefix+"/res/*filepath", resourceHandler)
 	r.OPTIONS(prefix+"/res/*filepath", resourceHandler)
@@ -85,31 +159,35 @@ func New(r *httprouter.Router, prefix string, conf Config) (wc *WebController) {
 
 	// Static assets
 	r.GET(prefix+"/favicon.ico" /*  */, wc.serveFile("/favicon.ico"))
-	r.GET(prefix+"/robots.txt" /*   */, wc.serveFile("/robots.txt"))
-
-	if conf.MaintenanceMode {
-		r.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			wc.templates.Run(w, r, "maintenance", wc.newTemplateData(w, r))
-		})
-		return wc
-	}
 
-	if conf.ProxyAPIRequests {
-		remoteURL, err := url.Parse(strings.TrimSuffix(conf.APIURLInternal, "/api"))
-		if err != nil {
-			panic(fmt.Errorf("failed to parse reverse proxy URL '%s': %w", conf.APIURLInternal, err))
-		}
+	// Files for crawlers and password managers. These are served outside of
+	// the middleware so they stay available during maintenance
+	r.GET(prefix+"/robots.txt" /*                  */, wc.serveRobots)
+	r.GET(prefix+"/.well-known/security.txt" /*    */, wc.serveSecurityTxt)
+	r.GET(prefix+"/.well-known/change-password" /**/, wc.serveChangePassword)
 
-		log.Info("Starting API proxy to %s", remoteURL)
-		var prox = httputil.NewSingleHostReverseProxy(remoteURL)
-		prox.Transport = wc.httpClient.Transport
+	// Collector for content security policy violations
+	r.POST(prefix+cspReportPath, wc.serveCSPReport)
+
+	if conf.ProxyAPIRequests {
+		log.Info("Starting API proxy to %s", rc.proxyURL)
+		wc.proxyRegistered = true
 
 		var proxyHandler = func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			// The proxy can be disabled by reloading the config
+			var rc = wc.runtime.Load()
+			if rc.proxy == nil {
+				wc.serveNotFoundPage(w, r)
+				return
+			}
+			if wc.maintenanceBlocksAPI(w, r) {
+				return
+			}
+
 			log.Info("Proxying request to %s", r.URL)
-			r.Host = remoteURL.Host
-			r.Header.Set("Origin", remoteURL.String())
-			prox.ServeHTTP(w, r)
+			r.Host = rc.proxyURL.Host
+			r.Header.Set("Origin", rc.proxyURL.String())
+			rc.proxy.ServeHTTP(w, r)
 		}
 
 		r.Handle("OPTIONS", "/api/*p", proxyHandler)
@@ -120,10 +198,15 @@ func New(r *httprouter.Router, prefix string, conf Config) (wc *WebController) {
 		r.Handle("DELETE", "/api/*p", proxyHandler)
 	}
 
-	r.NotFound = http.HandlerFunc(wc.serveNotFound)
+	// Unknown paths can still be documentation pages which were added after
+	// the server started
+	r.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wc.middleware(wc.serveDocs)(w, r, nil)
+	})
 
-	// Request method shorthands. These help keep the array of handlers aligned
-	const PST, GET = "POST", "GET"
+	// Request method shorthands. These help keep the array of handlers aligned.
+	// PUB is a GET route for a public page which is listed in the sitemap
+	const PST, GET, PUB = "POST", "GET", "PUB"
 
 	// Loop over the handlers and register all of them in the router
 	for _, h := range []struct {
@@ -132,28 +215,20 @@ func New(r *httprouter.Router, prefix string, conf Config) (wc *WebController) {
 		handler httprouter.Handle // The function to run when this API is called
 	}{
 		// General navigation
-		{GET, "" /*                */, wc.serveLandingPage()},
+		{PUB, "" /*                */, wc.serveLandingPage()},
 		{GET, "home" /*            */, wc.serveTemplate("home", handlerOpts{})},
-		{GET, "api" /*             */, wc.serveMarkdown("api.md", handlerOpts{})},
 		{GET, "history" /*         */, wc.serveTemplate("upload_history", handlerOpts{})},
 		{GET, "u/:id" /*           */, wc.serveFileViewer},
 		{GET, "u/:id/preview" /*   */, wc.serveFilePreview},
 		{GET, "l/:id" /*           */, wc.serveListViewer},
 		{GET, "d/*path" /*         */, wc.serveDirectory},
 		{GET, "t" /*               */, wc.serveTemplate("text_upload", handlerOpts{})},
-		{GET, "donation" /*        */, wc.serveMarkdown("donation.md", handlerOpts{})},
-		{GET, "widgets" /*         */, wc.serveTemplate("widgets", handlerOpts{})},
-		{GET, "about" /*           */, wc.serveMarkdown("about.md", handlerOpts{})},
+		{PUB, "widgets" /*         */, wc.serveTemplate("widgets", handlerOpts{})},
 		{GET, "appearance" /*      */, wc.serveTemplate("appearance", handlerOpts{})},
-		{GET, "hosting" /*         */, wc.serveMarkdown("hosting.md", handlerOpts{})},
-		{GET, "acknowledgements" /**/, wc.serveMarkdown("acknowledgements.md", handlerOpts{})},
-		{GET, "business" /*        */, wc.serveMarkdown("business.md", handlerOpts{})},
-		{GET, "limits" /*          */, wc.serveMarkdown("limits.md", handlerOpts{})},
-		{GET, "abuse" /*           */, wc.serveMarkdown("abuse.md", handlerOpts{})},
-		{GET, "filesystem" /*      */, wc.serveMarkdown("filesystem.md", handlerOpts{})},
-		{GET, "100_gigabit_ethernet", wc.serveMarkdown("100_gigabit_ethernet.md", handlerOpts{NoExec: true})},
-		{GET, "apps" /*            */, wc.serveTemplate("apps", handlerOpts{})},
-		{GET, "speedtest" /*       */, wc.serveTemplate("speedtest", handlerOpts{})},
+		{PUB, "apps" /*            */, wc.serveTemplate("apps", handlerOpts{})},
+		{PUB, "speedtest" /*       */, wc.serveTemplate("speedtest", handlerOpts{})},
+		{GET, "search" /*          */, wc.serveSearch},
+		{GET, "search.json" /*     */, wc.serveSearchJSON},
 
 		// User account pages
 		{GET, "register" /*         */, wc.serveForm(wc.registerForm, handlerOpts{NoEmbed: true})},
@@ -186,35 +261,59 @@ func New(r *httprouter.Router, prefix string, conf Config) (wc *WebController) {
 		{PST, "user/password_reset_confirm" /**/, wc.serveForm(wc.passwordResetConfirmForm, handlerOpts{NoEmbed: true})},
 
 		// Admin settings
-		{GET, "admin" /*                   */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/status" /*            */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/block_files" /*       */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/email_reporters" /*   */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/abuse_reports" /*     */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/ip_bans" /*           */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/user_bans" /*         */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/user_management" /*   */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/mollie_settlements" /**/, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/paypal_taxes" /*      */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/globals" /*           */, wc.serveForm(wc.adminGlobalsForm, handlerOpts{Auth: true})},
-		{PST, "admin/globals" /*           */, wc.serveForm(wc.adminGlobalsForm, handlerOpts{Auth: true})},
+		{GET, "admin" /*                   */, wc.serveTemplate("admin", handlerOpts{Admin: adminSectionPanel})},
+		{GET, "admin/status" /*            */, wc.serveTemplate("admin", handlerOpts{Admin: adminSectionStatus})},
+		{GET, "admin/block_files" /*       */, wc.serveTemplate("admin", handlerOpts{Admin: adminSectionBlockFiles})},
+		{GET, "admin/email_reporters" /*   */, wc.serveTemplate("admin", handlerOpts{Admin: adminSectionEmailReporters})},
+		{GET, "admin/abuse_reports" /*     */, wc.serveTemplate("admin", handlerOpts{Admin: adminSectionAbuseReports})},
+		{GET, "admin/ip_bans" /*           */, wc.serveTemplate("admin", handlerOpts{Admin: adminSectionIPBans})},
+		{GET, "admin/user_bans" /*         */, wc.serveTemplate("admin", handlerOpts{Admin: adminSectionUserBans})},
+		{GET, "admin/user_management" /*   */, wc.serveTemplate("admin", handlerOpts{Admin: adminSectionUserManagement})},
+		{GET, "admin/mollie_settlements" /**/, wc.serveTemplate("admin", handlerOpts{Admin: adminSectionMollieSettlement})},
+		{GET, "admin/paypal_taxes" /*      */, wc.serveTemplate("admin", handlerOpts{Admin: adminSectionPayPalTaxes})},
+		{GET, "admin/globals" /*           */, wc.serveForm(wc.adminGlobalsForm, handlerOpts{Admin: adminSectionGlobals})},
+		{PST, "admin/globals" /*           */, wc.serveForm(wc.adminGlobalsForm, handlerOpts{Admin: adminSectionGlobals})},
+		{GET, "admin/globals/export" /*    */, wc.serveAdminGlobalsExport},
+		{GET, "admin/globals/import" /*    */, wc.serveForm(wc.adminGlobalsImportForm, handlerOpts{Admin: adminSectionGlobals})},
+		{PST, "admin/globals/import" /*    */, wc.serveForm(wc.adminGlobalsImportForm, handlerOpts{Admin: adminSectionGlobals})},
+		{GET, "admin/maintenance" /*       */, wc.serveForm(wc.adminMaintenanceForm, handlerOpts{Admin: adminSectionMaintenance})},
+		{PST, "admin/maintenance" /*       */, wc.serveForm(wc.adminMaintenanceForm, handlerOpts{Admin: adminSectionMaintenance})},
 
 		// Misc
 		{GET, "misc/sharex/pixeldrain.com.sxcu", wc.serveShareXConfig},
 		{GET, "theme.css", wc.themeHandler},
+		{GET, "pattern.css", wc.servePatternCSS},
+		{GET, "patterns.json", wc.servePatternsJSON},
+		{GET, "themes.json", wc.serveThemesJSON},
+		{GET, "theme_export/:format", wc.serveThemeExport},
+		{GET, "theme_preview.svg", wc.serveThemePreview},
+		{GET, "theme_preview.png", wc.serveThemePreview},
+		{GET, "sitemap.xml", wc.serveSitemap},
 	} {
-		r.Handle(h.method, prefix+"/"+h.path, middleware(h.handler))
+		var method = h.method
+		if method == PUB {
+			method = GET
+			wc.sitemapPaths = append(wc.sitemapPaths, h.path)
+		}
+
+		r.Handle(method, prefix+"/"+h.path, wc.middleware(h.handler))
 
 		// Also support HEAD requests
-		if h.method == GET {
-			r.HEAD(prefix+"/"+h.path, middleware(h.handler))
+		if method == GET {
+			r.HEAD(prefix+"/"+h.path, wc.middleware(h.handler))
 		}
 	}
 
+	wc.registerDocs(r)
+
+	// Building the search index renders all documents, some of which request
+	// data from the API. We don't want to delay startup for that
+	go wc.buildSearchIndex()
+
 	return wc
 }
 
-func middleware(handle httprouter.Handle) httprouter.Handle {
+func (wc *WebController) middleware(handle httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		// Redirect the user to the correct domain
 		if strings.HasPrefix(r.Host, "www.") {
@@ -228,6 +327,16 @@ func middleware(handle httprouter.Handle) httprouter.Handle {
 
 		w.Header().Set("Strict-Transport-Security", "max-age=31536000")
 		w.Header().Set("X-Clacks-Overhead", "GNU Terry Pratchett")
+		r = wc.setSecurityHeaders(w, r)
+
+		w, done := compressResponse(w, r)
+		defer done()
+
+		r, blocked := wc.maintenanceBlocks(w, r)
+		if blocked {
+			return
+		}
+
 		handle(w, r, p)
 	}
 }
@@ -235,7 +344,17 @@ func middleware(handle httprouter.Handle) httprouter.Handle {
 type handlerOpts struct {
 	Auth    bool
 	NoEmbed bool
-	NoExec  bool
+
+	// Render a markdown document without executing it as a template
+	NoExec bool
+
+	// Render the markdown document on every request instead of caching it. For
+	// pages which show data of the logged in user
+	NoCache bool
+
+	// Section of the admin panel this route belongs to. Users without a role
+	// which grants access to this section get a 403 error. Implies Auth
+	Admin adminSection
 }
 
 func (wc *WebController) serveLandingPage() httprouter.Handle {
@@ -257,90 +376,103 @@ func (wc *WebController) serveLandingPage() httprouter.Handle {
 func (wc *WebController) serveTemplate(tpl string, opts handlerOpts) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		if opts.NoEmbed {
-			w.Header().Set("X-Frame-Options", "DENY")
+			wc.denyEmbedding(w, r)
 		}
 
-		var td = wc.newTemplateData(w, r)
-		if opts.Auth && !td.Authenticated {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		var td = wc.newPageData(w, r)
+		if !wc.checkAccess(w, r, td, opts) {
 			return
 		}
 
-		err := wc.templates.Run(w, r, tpl, td)
-		if err != nil && !util.IsNetError(err) {
+		var buf bytes.Buffer
+		if err := wc.templates.Run(&buf, r, tpl, td); err != nil {
 			log.Error("Error executing template '%s': %s", tpl, err)
+			w.Write(buf.Bytes())
+			return
 		}
+
+		wc.writePage(w, r, buf.Bytes())
 	}
 }
 
 func (wc *WebController) serveMarkdown(tpl string, opts handlerOpts) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		var err error
+
+		// The cache is replaced when the templates are reloaded, so we keep a
+		// reference to the one which belongs to the templates we're rendering
+		var cache = wc.templates.markdown()
+		var doc = cache.docs[tpl]
+		opts = doc.Meta.handlerOpts(opts)
+
 		if opts.NoEmbed {
-			w.Header().Set("X-Frame-Options", "DENY")
+			wc.denyEmbedding(w, r)
 		}
 
-		var tpld = wc.newTemplateData(w, r)
-		if opts.Auth && !tpld.Authenticated {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		var tpld = wc.newPageData(w, r)
+		if !wc.checkAccess(w, r, tpld, opts) {
 			return
 		}
 
-		// Execute the raw markdown template and save the result in a buffer
-		var tplBuf bytes.Buffer
-		err = wc.templates.Run(&tplBuf, r, tpl, tpld)
-		if err != nil && !util.IsNetError(err) {
-			log.Error("Error executing template '%s': %s", tpl, err)
-			return
-		}
+		var cacheKey = markdownCacheKey{template: tpl, authenticated: tpld.Authenticated}
+
+		page, ok := cache.get(cacheKey)
+		if opts.NoCache || !ok {
+			var src = doc.body
+			if !opts.NoExec {
+				// Execute the raw markdown template and save the result in a
+				// buffer
+				var tplBuf bytes.Buffer
+				err = wc.templates.Run(&tplBuf, r, tpl, tpld)
+				if err != nil && !util.IsNetError(err) {
+					log.Error("Error executing template '%s': %s", tpl, err)
+					return
+				}
+				src = tplBuf.Bytes()
+			}
 
-		// Parse the markdown document and save the resulting HTML in a buffer
-		renderer := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
-			Flags: blackfriday.CommonHTMLFlags | blackfriday.TOC,
-		})
-
-		// We parse the markdown document, walk through the nodes. Extract the
-		// title of the document, and the rest of the nodes are rendered like
-		// normal
-		var mdBuf bytes.Buffer
-
-		blackfriday.New(
-			blackfriday.WithRenderer(renderer),
-			blackfriday.WithExtensions(blackfriday.CommonExtensions|blackfriday.AutoHeadingIDs),
-		).Parse(
-			tplBuf.Bytes(),
-		).Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
-			// Capture the title of the document so we can put it at the top of
-			// the template and in the metadata. When entering a h1 node the
-			// first child will be the title of the document. Save that value
-			if node.Type == blackfriday.Heading && node.HeadingData.Level == 1 {
-				tpld.Title = string(node.FirstChild.Literal)
-				return blackfriday.SkipChildren
+			page = renderMarkdown(src)
+			page.Meta = doc.Meta
+			if page.Title == "" {
+				page.Title = doc.Meta.Title
 			}
 
-			// If this text node contains solely the text "[TOC]" then we render
-			// the table of contents
-			if node.Type == blackfriday.Text && bytes.Equal(node.Literal, []byte("[TOC]")) {
-				// Find the document node and render its TOC
-				for parent := node.Parent; ; parent = parent.Parent {
-					if parent.Type == blackfriday.Document {
-						renderer.RenderHeader(&mdBuf, parent)
-						return blackfriday.SkipChildren
-					}
-				}
+			// Templates are not executed for HEAD requests, so the result is
+			// empty
+			if !opts.NoCache && r.Method != "HEAD" {
+				cache.put(cacheKey, page)
 			}
+		}
+
+		page.Breadcrumbs = wc.docBreadcrumbs(cache.docs, tpl)
+		page.Children = wc.docChildren(cache.docs, tpl)
+		page.URL = getRequestAddress(r) + r.URL.Path
+
+		// The print mode shows the document without navigation, in the print
+		// colours of the theme
+		var wrapper = "markdown_wrapper"
+		if r.URL.Query().Has("print") {
+			wrapper = "markdown_print"
+		}
 
-			return renderer.RenderNode(&mdBuf, node, entering)
-		})
+		if page.Meta.NoIndex || wrapper == "markdown_print" {
+			w.Header().Set("X-Robots-Tag", "noindex")
+		}
 
-		// Pass the buffer's parsed contents to the wrapper template
-		tpld.Other = template.HTML(mdBuf.Bytes())
+		// Pass the rendered document to the wrapper template
+		tpld.Title = page.Title
+		tpld.OGData = wc.metadataFromMarkdown(r, page)
+		tpld.Other = page
 
 		// Execute the wrapper template
-		err = wc.templates.Run(w, r, "markdown_wrapper", tpld)
-		if err != nil && !util.IsNetError(err) {
+		var pageBuf bytes.Buffer
+		if err = wc.templates.Run(&pageBuf, r, wrapper, tpld); err != nil {
 			log.Error("Error executing template '%s': %s", tpl, err)
+			w.Write(pageBuf.Bytes())
+			return
 		}
+
+		wc.writePage(w, r, pageBuf.Bytes())
 	}
 }
 
@@ -350,7 +482,7 @@ func (wc *WebController) serveFile(path string) httprouter.Handle {
 		r *http.Request,
 		p httprouter.Params,
 	) {
-		http.ServeFile(w, r, wc.config.ResourceDir+"/static"+path)
+		http.ServeFile(w, r, wc.config().ResourceDir+"/static"+path)
 	}
 }
 
@@ -364,12 +496,11 @@ func (wc *WebController) serveForm(
 		p httprouter.Params,
 	) {
 		if opts.NoEmbed {
-			w.Header().Set("X-Frame-Options", "DENY")
+			wc.denyEmbedding(w, r)
 		}
 
 		var td = wc.newTemplateData(w, r)
-		if opts.Auth && !td.Authenticated {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		if !wc.checkAccess(w, r, td, opts) {
 			return
 		}
 
@@ -425,6 +556,15 @@ func (wc *WebController) serveForbidden(w http.ResponseWriter, r *http.Request)
 	wc.templates.Run(w, r, "403", wc.newTemplateData(w, r))
 }
 
+// serveNotFoundPage is the handler for unknown routes. During maintenance the
+// maintenance page is shown instead
+func (wc *WebController) serveNotFoundPage(w http.ResponseWriter, r *http.Request) {
+	if _, blocked := wc.maintenanceBlocks(w, r); blocked {
+		return
+	}
+	wc.serveNotFound(w, r)
+}
+
 func (wc *WebController) serveNotFound(w http.ResponseWriter, r *http.Request) {
 	log.Debug("Not Found: %s", r.URL)
 	w.WriteHeader(http.StatusNotFound)
@@ -435,6 +575,13 @@ func (wc *WebController) serveUnavailableForLegalReasons(w http.ResponseWriter,
 	wc.templates.Run(w, r, "451", wc.newTemplateData(w, r))
 }
 
+// personalized returns true if the response to this request can contain user
+// specific information. These responses may not be stored in shared caches
+func (wc *WebController) personalized(r *http.Request) bool {
+	_, err := wc.getAPIKey(r)
+	return err == nil
+}
+
 func (wc *WebController) getAPIKey(r *http.Request) (key string, err error) {
 	if cookie, err := r.Cookie("pd_auth_key"); err == nil {
 		if len(cookie.Value) == 36 {
@@ -444,20 +591,24 @@ func (wc *WebController) getAPIKey(r *http.Request) (key string, err error) {
 	return "", errors.New("not a valid pixeldrain authentication cookie")
 }
 
+// captchaKey returns the reCAPTCHA site key, or "none" if captchas are
+// disabled. An empty string is returned when the key can't be fetched
 func (wc *WebController) captchaKey() string {
-	// This only runs on the first request
-	if wc.captchaSiteKey == "" {
-		capt, err := wc.api.GetMiscRecaptcha()
-		if err != nil {
-			log.Error("Error getting recaptcha key: %s", err)
-			return ""
-		}
-		if capt.SiteKey == "" {
-			wc.captchaSiteKey = "none"
-		} else {
-			wc.captchaSiteKey = capt.SiteKey
-		}
+	// This only runs on the first request after the config is loaded
+	var rc = wc.runtime.Load()
+	if key := rc.captchaSiteKey.Load(); key != nil {
+		return *key
 	}
 
-	return wc.captchaSiteKey
+	capt, err := rc.api.GetMiscRecaptcha()
+	if err != nil {
+		log.Error("Error getting recaptcha key: %s", err)
+		return ""
+	}
+	var key = capt.SiteKey
+	if key == "" {
+		key = "none"
+	}
+	rc.captchaSiteKey.Store(&key)
+	return key
 }
@@ -0,0 +1,61 @@
+package webcontroller
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// serveSecurityTxt generates security.txt (RFC 9116) from the config. Without
+// a contact address there is nothing useful to put in the file, so a 404 is
+// returned
+func (wc *WebController) serveSecurityTxt(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var conf = wc.config()
+	if len(conf.SecurityContact) == 0 {
+		wc.serveNotFound(w, r)
+		return
+	}
+
+	var expires = conf.SecurityExpires
+	if expires.IsZero() {
+		// Rounded to the day so the response does not change on every request
+		expires = time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 6, 0)
+	}
+
+	var buf bytes.Buffer
+	for _, contact := range conf.SecurityContact {
+		buf.WriteString("Contact: " + contact + "\n")
+	}
+	buf.WriteString("Expires: " + expires.UTC().Format(time.RFC3339) + "\n")
+	for _, field := range []struct{ name, value string }{
+		{"Encryption", conf.SecurityEncryption},
+		{"Policy", conf.SecurityPolicy},
+		{"Acknowledgments", conf.SecurityAcknowledgments},
+		{"Preferred-Languages", conf.SecurityPreferredLanguages},
+	} {
+		if field.value != "" {
+			buf.WriteString(field.name + ": " + field.value + "\n")
+		}
+	}
+	buf.WriteString("Canonical: " + getRequestAddress(r) + wc.prefix + "/.well-known/security.txt\n")
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeCached(w, r, buf.Bytes(), false)
+}
+
+// serveChangePassword sends password managers to the page where the password
+// can be changed, see https://w3c.github.io/webappsec-change-password-url/
+func (wc *WebController) serveChangePassword(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var target = wc.config().ChangePasswordURL
+	if target == "" {
+		wc.serveNotFound(w, r)
+		return
+	}
+	if strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") {
+		target = wc.prefix + target
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}